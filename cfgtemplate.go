@@ -0,0 +1,265 @@
+package main
+
+// defaultConfigTemplate is written out as krclone-cfg.toml when there is no
+// config, to give new users something to start from. Keep it in sync with
+// krclone-cfg.toml.
+const defaultConfigTemplate = `# The config file version. Don't change this.
+config_version = 11
+# The directory to sync book to. Path is realative to the 
+# root of the user accessable internal memory
+# To sync several remote dirs to separate book directories, give an
+# array here and an array of the same length for rclone_root_dir. Each
+# book dir is synced from the matching remote dir, and has its own
+# metadata file. Eg: ["fiction", "non-fiction"]
+krclone_book_dir = "krclone-books"
+# Where the book directory is. "onboard" for the internal memory, or
+# "sd" for the SD card (mounted at /mnt/sd). Reading settings and
+# annotations can only be synced for books on the internal memory.
+book_storage = "onboard"
+# The name/path of the rclone config path. This path is relative
+# to the kobo-rclone directory.
+rclone_config = "rclone.conf"
+# The rclone remote name to sync to. This is the name used when
+# setting up the rclone config file.
+rclone_remote_name = "krclone"
+# The remote directory to sync to. May be blank to sync to the
+# root directory of your remote storage. An array when
+# krclone_book_dir is one, eg: ["Books/Fiction", "Books/Non-fiction"]
+rclone_root_dir = ""
+# Files and folders to exclude from the sync, using rclone filter
+# patterns. Eg: ["Samples/**", "*.sdr/**"]
+exclude_paths = []
+# Optional rclone filter rules file, for more complex filtering. See
+# https://rclone.org/filtering/ for the format. Path is relative to the
+# kobo-rclone directory, unless absolute.
+filter_file = ""
+# Password for an encrypted rclone config file. May be left blank if
+# the config is not encrypted, or if RCLONE_CONFIG_PASS is already set
+# in the environment.
+rclone_config_pass = ""
+# Directory for rclone's cache and temporary files. Set this to keep
+# them off the small root partition during large transfers. Path is
+# relative to the kobo-rclone directory, unless absolute. Leave blank
+# to use rclone's defaults.
+rclone_cache_dir = ""
+# Optional config file on the remote, for managing several devices from
+# one place. It is downloaded at startup, and its options override the
+# ones in this file. Options that are paths to files or devices on the
+# Kobo are always taken from this file: rclone_config, kepubify_bin,
+# kobo_db_path, filter_file, battery_path, rclone_cache_dir,
+# touch_event_device, button_event_file and metadata_file. Path is
+# relative to rclone_root_dir, or may be a full rclone path, eg:
+# "krclone:configs/kobo.toml". If it can't be downloaded or is invalid,
+# this file is used as is.
+remote_config = ""
+# When this config file is from an older version of kobo-rclone, add
+# any new options to it (commented out, with their defaults). The old
+# file is kept as krclone-cfg.toml.bak. Either way, new options use
+# their defaults until set.
+migrate_config = false
+# After syncing, extract the books from any .zip, .tar.gz or .tgz
+# archives in the book directory, then delete the archives. Archives
+# without any books in them are left alone. Extracted archives are
+# listed in krclone-extracted.txt, so later syncs don't download them
+# again or delete their books. Remove a line from it to extract that
+# archive again.
+extract_archives = false
+# Optional path to the kepubify program. When set, newly synced epubs
+# are converted to kepubs before Nickel imports them. Path is relative
+# to the kobo-rclone directory, unless absolute.
+kepubify_bin = ""
+# Keep the original epub after converting it to a kepub. With "sync"
+# mode, the kepub is removed along with the epub when the book is deleted
+# from the remote. If false, the original epub is removed, and listed in
+# krclone-converted.txt in the kobo-rclone directory so it isn't
+# downloaded again. Its kepub then has to be deleted by hand if the book
+# is removed from the remote, and changes to the epub are not picked up.
+kepub_keep_original = true
+# Match Calibre metadata for "Book.epub" to "Book.kepub.epub" on the
+# device, if the book has been converted to a kepub.
+kepub_aware = true
+# Make the library thumbnails for newly synced epubs, from the cover in
+# the book, instead of leaving Nickel to make them on import. Speeds up
+# importing large numbers of books. cover_workers covers are made at a
+# time; raising it may help on multi-core models.
+generate_covers = false
+cover_workers = 2
+# If a book's filename on the device doesn't match Calibre's, match it
+# by title and author instead. Only used when exactly one book on the
+# device has that title and author.
+fallback_match = false
+# Turn WiFi on before syncing, and off again afterwards. Leave this off
+# if you connect to WiFi through Nickel.
+manage_wifi = false
+# The Calibre metadata file. Path is relative to the book directory,
+# unless absolute.
+metadata_file = ".metadata.calibre"
+# Download the latest metadata file from the remote before updating
+# metadata, in case it changed after the books were synced.
+refresh_metadata_file = false
+# Warn before syncing if the battery is below this percentage. The sync
+# only goes ahead if the screen is tapped.
+min_battery_percent = 20
+# The sysfs file reporting battery capacity. Leave blank to detect it.
+battery_path = ""
+# The number of file transfers and checkers rclone runs in parallel.
+# Set to 0 to use rclone's defaults. Lower values may help on flaky WiFi.
+transfers = 0
+checkers = 0
+# Use rclone's --fast-list, which speeds up syncs from bucket based
+# remotes (eg: S3) with many files. It holds the whole remote listing
+# in memory, which may be too much for the Kobo's limited RAM with
+# very large libraries.
+fast_list = false
+# How rclone decides whether a book has changed. "default" compares
+# modification time and size. "checksum" compares checksums, if the
+# remote supports them. "size-only" compares just the size, and is
+# recommended, as the Kobo's vfat filesystem only stores modification
+# times to 2 seconds, which can cause unchanged books to be downloaded
+# again on every sync.
+compare_method = "default"
+# Advanced, and unsupported: extra flags passed to rclone sync as is,
+# after kobo-rclone's own flags. Useful for debugging, eg:
+# ["--retries", "5", "--dump", "headers"]
+extra_rclone_args = []
+# EXPERIMENTAL: run the sync as a job in "rclone rcd" (rclone's remote
+# control daemon), which reports accurate progress while syncing. The
+# daemon quits before Nickel imports the books, as rclone runs from
+# the internal memory. Needs a recent rclone.
+use_rcd = false
+# How long to wait (in milliseconds) after Nickel unmounts the internal
+# memory before remounting it. Increase this if the remount fails now
+# and then.
+unmount_grace_ms = 1000
+# How long to wait (in milliseconds) after remounting the internal
+# memory before opening the Kobo database.
+remount_settle_ms = 500
+# How long to wait (in seconds) for Nickel to remount the internal
+# memory after the simulated USB connection. If it doesn't, the USB
+# cable is unplugged again, and we wait twice as long once more.
+remount_timeout_sec = 30
+# Check and repair the internal memory's filesystem with fsck.vfat (if
+# available) before remounting it. This can fix "database is read-only"
+# errors after a crash or unclean shutdown.
+fsck_before_mount = false
+# How rclone transfers books. "sync" makes the book directory match the
+# remote, deleting books removed from the remote. "copy" only adds and
+# updates books, and never deletes.
+# EXPERIMENTAL: "mount" mounts the remote on the book directory with
+# "rclone mount", and leaves it running (with WiFi on), so books are
+# only downloaded when opened. This needs FUSE support on the device.
+# Nickel does not import books from the mount, so it is mostly useful
+# with readers that open files directly, such as KOReader. Updating
+# metadata (with --metadata-only) unmounts the remote again.
+sync_mode = "sync"
+# Only sync books modified on the remote within this time, eg: "30d".
+# Leave blank to sync everything. Best used with "copy" mode.
+max_age = ""
+# Only download books that aren't already in the book directory, which
+# is much faster for large libraries that only grow. Books are never
+# deleted, as in "copy" mode, and changes to books already downloaded
+# are not picked up.
+ignore_existing = false
+# The touchscreen input device, eg: "/dev/input/event1". Used to press
+# the connect button, to replay a captured tap (see button_event_file)
+# and to wait for taps. Leave blank to detect it.
+touch_event_device = ""
+# If Nickel's connect button can't be found, refresh the screen after
+# this many failed attempts, and unplug and replug the simulated USB
+# cable after this many. Attempts are half a second apart. Set to 0 to
+# disable either.
+button_refresh_after = 10
+button_replug_after = 40
+# Check the screen for the USB connect button before pressing it, so a
+# stray press can't dismiss some other dialog. Models where the screen
+# can't be checked fall back to pressing blindly.
+confirm_connect_screen = false
+# On models where the connect button can't be pressed automatically,
+# run "./krclone --capture-button" and tap the connect button when it
+# appears. The tap is saved to this file (relative to the kobo-rclone
+# directory), and replayed to press the button from then on. Leave blank
+# to use "button-event.bin", if it exists.
+button_event_file = ""
+# How much detail rclone writes to rclone.log in the kobo-rclone
+# directory. One of "DEBUG", "INFO", "NOTICE" or "ERROR". The name of
+# the book being synced is only shown on screen with "INFO" or "DEBUG".
+rclone_log_level = "INFO"
+# The Kobo database, relative to the root of the internal memory.
+kobo_db_path = ".kobo/KoboReader.sqlite"
+# Back up the Kobo database before updating metadata. The backup is
+# saved as KoboReader.sqlite.krbak, with the one before that kept as
+# KoboReader.sqlite.krbak.1
+backup_db = true
+# Check the Kobo database for corruption before updating metadata, and
+# leave it alone if it is damaged.
+check_db_integrity = true
+# Clear the screen at the start of the sync and metadata phases, so
+# their messages don't get mixed up.
+clear_between_phases = true
+# The number of status lines kept on screen, between 1 and 20. It is
+# lowered to the number of lines that fit on the screen. Lower it further
+# if long messages still run off the bottom.
+status_lines = 5
+# How chatty status messages are. 0 only shows the start and end of each
+# phase, and errors. 1 is normal. 2 shows debugging information.
+verbosity = 1
+# How long (in seconds) to leave the message on screen when kobo-rclone
+# has to stop because of an error. 0 uses the default for each message.
+# The full error is always written to the log.
+error_message_sec = 0
+# The animation shown while waiting on a long step. One of "classic",
+# "dots", "braille" or "none".
+spinner_style = "classic"
+# Which metadata to write to the Kobo database. Any of "description",
+# "series", "seriesindex", "title", "author" and "rating". Every book
+# is updated on the next run after changing this, or the three options
+# below.
+metadata_fields = ["description", "series", "seriesindex"]
+# Zero pad series numbers to this many digits, eg: 2 writes book 1 as
+# "01", which sorts correctly in some views. 0 leaves them unpadded.
+series_index_pad = 0
+# The content table column Calibre comments are written to. Must exist
+# in this firmware's database, or comments are skipped.
+comments_column = "Description"
+# Remove HTML from Calibre comments, which often look poor on the
+# device.
+strip_comments_html = false
+# Compare each book's metadata with the Kobo database before updating
+# it, and leave books that already match alone. The changes made to
+# each book are written to the log.
+only_changed_metadata = false
+# The file extensions treated as books, matched regardless of case. Only
+# these files count towards the empty folder check, are reported as new
+# books, are extracted from archives or are converted by kepubify.
+book_extensions = [".epub", ".kepub.epub", ".pdf", ".mobi", ".cbz", ".cbr", ".txt", ".html", ".htm", ".rtf"]
+# Copy highlights and bookmarks between devices. After the metadata is
+# updated, each book's annotations are saved to a "<book>.annot.json"
+# file next to it and uploaded to the remote. Annotations downloaded
+# from other devices are added to the Kobo database.
+sync_annotations = false
+# Apply per book reading settings from a "<book>.settings.json" file
+# next to the book, eg: {"font_family": "Georgia", "font_size": 22,
+# "line_height": 1.4, "alignment": "justify", "left_margin": 10,
+# "right_margin": 10}. Settings left out are not changed. Only some
+# firmware versions keep reading settings per book.
+reading_settings = false
+# If a metadata update fails, try it again on the next run instead of
+# syncing books.
+retry_metadata_on_failure = false
+# Update metadata straight after syncing, instead of on the next run.
+# Books Nickel hasn't finished importing by then are updated on the
+# run after.
+single_run = false
+# Connect and disconnect the simulated USB cable again after updating
+# metadata, so Nickel reindexes the library and shows the changes
+# straight away.
+rescan_after_metadata = false
+
+# Environment variables for rclone, so credentials can be kept out of
+# the rclone config file. Only RCLONE_ variables are used, and their
+# values are never logged. This section must stay at the end of the
+# file. Eg:
+# [env]
+# RCLONE_CONFIG_KRCLONE_TYPE = "s3"
+# RCLONE_CONFIG_KRCLONE_SECRET_ACCESS_KEY = "..."
+`
@@ -17,18 +17,44 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"container/list"
+	"crypto/rand"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -41,12 +67,52 @@ import (
 // Mountpoints we will be using
 const onboardMnt = "/mnt/onboard/"
 const tmpOnboardMnt = "/mnt/tmponboard/"
+const sdMnt = "/mnt/sd/"
 
 // Internal SD card device
 const internalMemoryDev = "/dev/mmcblk0p3"
 
+// Errors from Display.ButtonScan
+var (
+	ErrButtonNotFound    = errors.New("button not found")
+	ErrButtonPressFailed = errors.New("button press failure")
+	ErrTouchFailed       = errors.New("touch event failure")
+)
+
+// Touch screen input device used by most models
+const touchEventDev = "/dev/input/event1"
+
+// Older versions flagged a pending metadata update with this file
 const metaLockFile = "krmeta.lock"
 
+const stateFile = "krclone-state.json"
+
+const resultFile = "krclone-result.json"
+
+const progressFile = "krclone-progress.json"
+
+// Books listed in this file in the book directory are never synced or updated
+const krIgnoreFile = ".krignore"
+
+// Records the archives extracted after a sync, and the books extracted from
+// them, as rclone filter rules, so later syncs leave them alone
+const extractedFile = "krclone-extracted.txt"
+
+// Records the epubs removed after converting them to kepubs, as rclone filter
+// rules, so later syncs don't download them again
+const convertedFile = "krclone-converted.txt"
+
+// Highlights and bookmarks for a book are kept next to it in this file
+const annotationSuffix = ".annot.json"
+
+// Per book reading settings are read from this file next to the book
+const settingsSuffix = ".settings.json"
+
+// The number of books updated per database transaction
+const metadataBatchSize = 100
+
+const rcloneLogFile = "rclone.log"
+
 const krVersionString = "0.2.0"
 
 // This is easier as a global due to the way FBInk works
@@ -54,302 +120,4766 @@ var fbinkOpts gofbink.FBInkConfig
 
 var fbMsgBuffer = list.New()
 
+// touchDevice is the touchscreen the connect button is pressed through. FBInk
+// only knows about event1, so this is bind mounted over it for each press.
+var touchDevice = touchEventDev
+
+// The number of status lines kept on screen
+var fbMaxLines = 5
+
+// The text row the first status line is printed on
+const fbFirstRow = 4
+
+// fbScreenRows is the number of text rows below fbFirstRow, as FBInk reports
+// them for our font size. It is 0 until FBInk is initialised.
+var fbScreenRows = 0
+
+// setMaxLines sets fbMaxLines, keeping it to what fits on the screen
+func setMaxLines(n int) {
+	if fbScreenRows > 0 && n > fbScreenRows {
+		log.Printf("Only %d status lines fit on the screen, not %d", fbScreenRows, n)
+		n = fbScreenRows
+	}
+	fbMaxLines = n
+}
+
+// Status message levels, compared against the verbosity config option
+const (
+	// levelQuiet messages (phase start/end and errors) are always shown
+	levelQuiet = iota
+	levelNormal
+	levelDebug
+)
+
+// How chatty status messages are
+var verbosity = levelNormal
+
+// The number of digits series indices are zero padded to
+var seriesIndexPad = 0
+
+// Whether HTML is removed from Calibre comments before they are written
+var stripCommentsHTML bool
+
+// metadataSettings describes the options that change what the metadata update
+// writes. It is part of every metadata hash, so changing any of them updates
+// every book on the next run.
+var metadataSettings string
+
+// Whether books already matching their metadata in the database are skipped
+var onlyChangedMetadata bool
+
+// The number of books whose changes a dry run shows on screen
+const previewDiffBooks = 5
+
+var columnNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var (
+	htmlBreakRegex = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>|</h[1-6]>`)
+	htmlTagRegex   = regexp.MustCompile(`<[^>]*>`)
+	blankLineRegex = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// Set by --simulate-device, to fake the USB/remount dance rather than
+// unmounting the live filesystem
+var simulateDevice bool
+
+// Set while Nickel thinks a USB cable is plugged in, so an interrupted run
+// knows to unplug it
+var usbPlugged int32
+
+// handlingFatal is set once chkErrFatal starts restoring the device and exiting
+var handlingFatal int32
+
+// currentPhase names the phase being run, so a crash can be reported against it
+var currentPhase atomic.Value
+
+// errorMessageSec overrides how long fatal error messages stay on screen, if
+// set from the config
+var errorMessageSec int
+
+// The oldest rclone known to support all the flags we pass it
+const minRcloneVersion = "1.45"
+
+// The version of the rclone binary, as detected at startup
+var rcloneVersion string
+
+var rcloneVersionRegex = regexp.MustCompile(`rclone v(\d+)\.(\d+)(\.\d+)?`)
+
+// configVersion is the current version of the config file. Bump it when adding
+// options, so old config files can be migrated.
+const configVersion = 11
+
+var (
+	configVersionRegex = regexp.MustCompile(`(?m)^config_version\s*=.*$`)
+	tableHeaderRegex   = regexp.MustCompile(`(?m)^\[`)
+)
+
+// Lines in the rclone log naming the file being, or just, transferred
+var (
+	transferringRegex = regexp.MustCompile(`(?m)^ \*\s+(.+?):\s*\d+% /`)
+	copiedRegex       = regexp.MustCompile(`(?m)INFO\s*: (.+?): Copied \(`)
+)
+
+// rclone durations look like "30d" or "1h30m", or may be a date
+var maxAgeRegex = regexp.MustCompile(`^((\d+(\.\d+)?(ms|s|m|h|d|w|M|y))+|\d{4}-\d{2}-\d{2})$`)
+
 // BookMetadata is a struct to store data from a Calibre metadata JSON file
 type BookMetadata struct {
-	Lpath       string  `json:"lpath"`
-	Series      string  `json:"series"`
-	SeriesIndex float64 `json:"series_index"`
-	Comments    string  `json:"comments"`
+	Lpath       string   `json:"lpath"`
+	Title       string   `json:"title"`
+	Authors     []string `json:"authors"`
+	Series      string   `json:"series"`
+	SeriesIndex *float64 `json:"series_index"`
+	Comments    string   `json:"comments"`
+	// Rating is out of 10, in half star steps. omitempty keeps metadata hashes
+	// from before ratings were supported unchanged.
+	Rating *float64 `json:"rating,omitempty"`
+}
+
+// UnmarshalJSON reads a book's Calibre metadata. Some exporters write the
+// series index as a string, which is accepted too. A series index that can't
+// be parsed is logged and treated as missing, rather than written as 0.
+func (meta *BookMetadata) UnmarshalJSON(data []byte) error {
+	type bookMetadata BookMetadata
+	aux := struct {
+		*bookMetadata
+		SeriesIndex json.RawMessage `json:"series_index"`
+	}{bookMetadata: (*bookMetadata)(meta)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	meta.SeriesIndex = nil
+	raw := strings.TrimSpace(string(aux.SeriesIndex))
+	if raw == "" || raw == "null" {
+		return nil
+	}
+	var index float64
+	if err := json.Unmarshal(aux.SeriesIndex, &index); err == nil {
+		meta.SeriesIndex = &index
+		return nil
+	}
+	var indexStr string
+	if err := json.Unmarshal(aux.SeriesIndex, &indexStr); err == nil {
+		indexStr = strings.TrimSpace(indexStr)
+		if indexStr == "" {
+			return nil
+		}
+		if index, err = strconv.ParseFloat(indexStr, 64); err == nil {
+			meta.SeriesIndex = &index
+			return nil
+		}
+	}
+	log.Printf("ignoring invalid series_index %s for %s", raw, meta.Lpath)
+	return nil
+}
+
+// metadataField describes how a piece of Calibre metadata is written to a
+// column of the content table
+type metadataField struct {
+	column string
+	// keepExisting leaves the column alone when the value is nil, instead of
+	// writing NULL
+	keepExisting bool
+	value        func(meta BookMetadata) interface{}
+}
+
+// metadataFields maps the names used in the metadata_fields config option to
+// the way each is written
+var metadataFields = map[string]metadataField{
+	"description": {"Description", false, func(meta BookMetadata) interface{} {
+		if stripCommentsHTML {
+			return stripHTML(meta.Comments)
+		}
+		return meta.Comments
+	}},
+	// A missing series leaves the existing series alone
+	"series": {"Series", true, func(meta BookMetadata) interface{} {
+		if meta.Series == "" {
+			return nil
+		}
+		return meta.Series
+	}},
+	// A missing series index is written as NULL, rather than book #0
+	"seriesindex": {"SeriesNumber", false, func(meta BookMetadata) interface{} {
+		if meta.SeriesIndex == nil {
+			return nil
+		}
+		return formatSeriesIndex(*meta.SeriesIndex, seriesIndexPad)
+	}},
+	"title": {"Title", true, func(meta BookMetadata) interface{} {
+		if meta.Title == "" {
+			return nil
+		}
+		return meta.Title
+	}},
+	"author": {"Attribution", true, func(meta BookMetadata) interface{} {
+		if len(meta.Authors) == 0 {
+			return nil
+		}
+		return strings.Join(meta.Authors, " & ")
+	}},
+	// Kobo ratings are whole stars from 0 to 5. A missing rating leaves the
+	// existing rating alone.
+	"rating": {"Rating", true, func(meta BookMetadata) interface{} {
+		if meta.Rating == nil {
+			return nil
+		}
+		return int(math.Min(math.Max(math.Round(*meta.Rating/2), 0), 5))
+	}},
+}
+
+// stripHTML turns Calibre's HTML comments into plain text, keeping paragraph
+// and line breaks
+func stripHTML(str string) string {
+	str = htmlBreakRegex.ReplaceAllString(str, "\n")
+	str = htmlTagRegex.ReplaceAllString(str, "")
+	str = html.UnescapeString(str)
+	str = blankLineRegex.ReplaceAllString(str, "\n\n")
+	return strings.TrimSpace(str)
+}
+
+// formatSeriesIndex formats a series index, zero padding the whole number part
+// to pad digits. Eg: 1.5 padded to 2 digits is "01.5".
+func formatSeriesIndex(index float64, pad int) string {
+	str := strconv.FormatFloat(index, 'f', -1, 64)
+	if index < 0 {
+		return str
+	}
+	whole := strings.SplitN(str, ".", 2)[0]
+	if len(whole) < pad {
+		str = strings.Repeat("0", pad-len(whole)) + str
+	}
+	return str
+}
+
+// buildUpdateSQL builds the UPDATE statement for the selected metadata fields,
+// returning the fields in the order their values must be passed
+func buildUpdateSQL(fieldNames []string) (string, []metadataField, error) {
+	if len(fieldNames) == 0 {
+		return "", nil, errors.New("no metadata fields selected")
+	}
+	var setters []string
+	var fields []metadataField
+	for _, name := range fieldNames {
+		field, ok := metadataFields[strings.ToLower(name)]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown metadata field %q", name)
+		}
+		if field.keepExisting {
+			setters = append(setters, fmt.Sprintf("%s=COALESCE(?, %s)", field.column, field.column))
+		} else {
+			setters = append(setters, field.column+"=?")
+		}
+		fields = append(fields, field)
+	}
+	query := "UPDATE content SET " + strings.Join(setters, ", ") + contentIDMatch
+	return query, fields, nil
+}
+
+// matchOptions controls how books in the metadata are matched to books in the
+// Kobo database, when their ContentID doesn't match
+type matchOptions struct {
+	// kepubAware tries the ContentID of the book converted to a kepub
+	kepubAware bool
+	// fallback matches on title and author, if exactly one book has them
+	fallback bool
+}
+
+// Matches a book by both the raw and URL-encoded forms of its ContentID
+const contentIDMatch = " WHERE ContentID = ? OR ContentID = ?"
+
+// Matches a book by its title and author, but only if no other book has them
+const titleAuthorMatch = " WHERE ContentType = 6 AND Title = ? AND Attribution = ?" +
+	" AND (SELECT COUNT(*) FROM content WHERE ContentType = 6 AND Title = ? AND Attribution = ?) = 1"
+
+// titleAuthorArgs returns the arguments for titleAuthorMatch, or nil if the
+// book has no title or author to match on
+func titleAuthorArgs(meta BookMetadata) []interface{} {
+	if meta.Title == "" || len(meta.Authors) == 0 {
+		return nil
+	}
+	author := strings.Join(meta.Authors, " & ")
+	return []interface{}{meta.Title, author, meta.Title, author}
+}
+
+// bookMatch is one way of finding a book's row in the content table
+type bookMatch struct {
+	where string
+	args  []interface{}
+}
+
+// bookMatches returns the ways of finding a book's row, in the order the
+// metadata update tries them
+func bookMatches(ksDir string, meta BookMetadata, match matchOptions) []bookMatch {
+	var matches []bookMatch
+	for _, p := range []string{meta.Lpath, kepubLpath(meta.Lpath)} {
+		if p == "" || (p != meta.Lpath && !match.kepubAware) {
+			continue
+		}
+		contentID := lpathContentID(ksDir, p)
+		matches = append(matches, bookMatch{contentIDMatch, []interface{}{contentID, encodeLpath(contentID)}})
+	}
+	if matchArgs := titleAuthorArgs(meta); match.fallback && matchArgs != nil {
+		matches = append(matches, bookMatch{titleAuthorMatch, matchArgs})
+	}
+	return matches
+}
+
+// fieldDiff is a column whose value in the database differs from the value
+// the metadata update would write
+type fieldDiff struct {
+	column   string
+	old, new string
+}
+
+// rowQueryer is satisfied by both *sql.DB and *sql.Tx
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// dbValueString converts a value read from, or written to, the database to a
+// string for comparison. ok is false for NULL.
+func dbValueString(v interface{}) (str string, ok bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case []byte:
+		return string(v), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// metadataDiffs compares a book's row in the database with the values the
+// metadata update would write. found is false if the book isn't in the
+// database.
+func metadataDiffs(q rowQueryer, fields []metadataField, meta BookMetadata, matches []bookMatch) (diffs []fieldDiff, found bool, err error) {
+	var columns []string
+	for _, field := range fields {
+		columns = append(columns, field.column)
+	}
+	current := make([]interface{}, len(fields))
+	dest := make([]interface{}, len(fields))
+	for i := range current {
+		dest[i] = &current[i]
+	}
+	for _, m := range matches {
+		err = q.QueryRow("SELECT "+strings.Join(columns, ", ")+" FROM content"+m.where, m.args...).Scan(dest...)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		for i, field := range fields {
+			newVal, newOK := dbValueString(field.value(meta))
+			oldVal, oldOK := dbValueString(current[i])
+			if !newOK && field.keepExisting {
+				continue
+			}
+			if newOK != oldOK || newVal != oldVal {
+				diffs = append(diffs, fieldDiff{field.column, oldVal, newVal})
+			}
+		}
+		return diffs, true, nil
+	}
+	return nil, false, nil
+}
+
+// shortValue shortens a metadata value to fit on a line of the screen
+func shortValue(str string) string {
+	str = strings.Join(strings.Fields(str), " ")
+	if runes := []rune(str); len(runes) > 20 {
+		return string(runes[:20]) + "..."
+	}
+	return str
+}
+
+// bookDiffers checks whether the metadata update would change a book, logging
+// the changes. Books that can't be checked are assumed to differ.
+func bookDiffers(q rowQueryer, ksDir string, fields []metadataField, meta BookMetadata, match matchOptions) bool {
+	diffs, found, err := metadataDiffs(q, fields, meta, bookMatches(ksDir, meta, match))
+	if err != nil {
+		log.Printf("could not compare metadata for %s: %s", meta.Lpath, err)
+		return true
+	}
+	for _, diff := range diffs {
+		log.Printf("%s: %s %q -> %q", meta.Lpath, diff.column, diff.old, diff.new)
+	}
+	return !found || len(diffs) > 0
+}
+
+// metadataProgress records the last book committed by an update, so that an
+// interrupted update can be resumed
+type metadataProgress struct {
+	Index int    `json:"index"`
+	Lpath string `json:"lpath"`
+}
+
+// runOptions holds the command line options that change how a run behaves
+type runOptions struct {
+	fullMetadata    bool
+	restartMetadata bool
+	// dryRun reports what the metadata update would do, without writing anything
+	dryRun bool
+}
+
+// RunState is where a run got to in the sync/metadata lifecycle
+type RunState string
+
+// The run states. A sync leaves us awaiting metadata, which the next run
+// updates.
+const (
+	stateIdle             RunState = "idle"
+	stateSyncing          RunState = "syncing"
+	stateAwaitingMetadata RunState = "awaiting_metadata"
+	stateUpdatingMetadata RunState = "updating_metadata"
+)
+
+// KRcloneState is a struct to store state that persists between runs
+type KRcloneState struct {
+	RunState RunState `json:"run_state"`
+	// MetadataHashes maps a book's lpath to a hash of the metadata last written for it
+	MetadataHashes map[string]string `json:"metadata_hashes"`
+	// LastSeen maps a book's lpath to when it was last in the metadata file
+	LastSeen map[string]time.Time `json:"last_seen"`
+}
+
+// RunResult is a struct to store the outcome of a run, which is written to a
+// file for the benefit of external scripts
+type RunResult struct {
+	Phase        string `json:"phase"`
+	OK           bool   `json:"ok"`
+	Error        string `json:"error"`
+	BooksUpdated int    `json:"books_updated"`
+	DurationSec  int    `json:"duration_sec"`
+	// RcloneVersion is the version reported by the rclone binary, if known
+	RcloneVersion string `json:"rclone_version,omitempty"`
+	// Timings is how long each phase and step took, in seconds
+	Timings map[string]float64 `json:"timings_sec,omitempty"`
+}
+
+// phaseTiming records how long a phase, or a step within one, took
+type phaseTiming struct {
+	name    string
+	elapsed time.Duration
+}
+
+// Timings for the phases run so far. Only one phase runs at a time.
+var phaseTimings []phaseTiming
+
+// stringList is a config option that may be either a string or an array of
+// strings
+type stringList []string
+
+// UnmarshalTOML decodes a single string as a one element stringList
+func (l *stringList) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*l = stringList{v}
+	case []interface{}:
+		list := make(stringList, 0, len(v))
+		for _, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a string, got %v", item)
+			}
+			list = append(list, str)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("expected a string or array of strings, got %v", data)
+	}
+	return nil
 }
 
 // KRcloneConfig is a struct to store the kobo-rclone configuration options
 type KRcloneConfig struct {
-	KRbookDir    string `toml:"krclone_book_dir"`
-	RcloneCfg    string `toml:"rclone_config"`
-	RCremoteName string `toml:"rclone_remote_name"`
-	RCrootDir    string `toml:"rclone_root_dir"`
+	// BookDirs and RootDirs are parallel lists, each book dir syncing with the
+	// matching remote dir
+	BookDirs stringList `toml:"krclone_book_dir"`
+	RootDirs stringList `toml:"rclone_root_dir"`
+	// KRbookDir and RCrootDir are the pair of dirs currently in use
+	KRbookDir              string            `toml:"-"`
+	RcloneCfg              string            `toml:"rclone_config"`
+	RCremoteName           string            `toml:"rclone_remote_name"`
+	RCrootDir              string            `toml:"-"`
+	KepubifyBin            string            `toml:"kepubify_bin"`
+	KepubKeepOriginal      bool              `toml:"kepub_keep_original"`
+	GenerateCovers         bool              `toml:"generate_covers"`
+	CoverWorkers           int               `toml:"cover_workers"`
+	ExcludePaths           []string          `toml:"exclude_paths"`
+	RcloneConfigPass       string            `toml:"rclone_config_pass"`
+	ManageWifi             bool              `toml:"manage_wifi"`
+	MetadataFile           string            `toml:"metadata_file"`
+	MinBatteryPercent      int               `toml:"min_battery_percent"`
+	BatteryPath            string            `toml:"battery_path"`
+	Transfers              int               `toml:"transfers"`
+	Checkers               int               `toml:"checkers"`
+	RemountSettleMs        int               `toml:"remount_settle_ms"`
+	SyncMode               string            `toml:"sync_mode"`
+	MaxAge                 string            `toml:"max_age"`
+	TouchEventDevice       string            `toml:"touch_event_device"`
+	RcloneLogLevel         string            `toml:"rclone_log_level"`
+	KoboDBPath             string            `toml:"kobo_db_path"`
+	BackupDB               bool              `toml:"backup_db"`
+	FilterFile             string            `toml:"filter_file"`
+	ClearBetweenPhases     bool              `toml:"clear_between_phases"`
+	MetadataFields         []string          `toml:"metadata_fields"`
+	FastList               bool              `toml:"fast_list"`
+	RefreshMetadataFile    bool              `toml:"refresh_metadata_file"`
+	StatusLines            int               `toml:"status_lines"`
+	Verbosity              int               `toml:"verbosity"`
+	ErrorMessageSec        int               `toml:"error_message_sec"`
+	SyncAnnotations        bool              `toml:"sync_annotations"`
+	RcloneCacheDir         string            `toml:"rclone_cache_dir"`
+	RetryMetadataOnFailure bool              `toml:"retry_metadata_on_failure"`
+	KepubAware             bool              `toml:"kepub_aware"`
+	CheckDBIntegrity       bool              `toml:"check_db_integrity"`
+	SpinnerStyle           string            `toml:"spinner_style"`
+	CompareMethod          string            `toml:"compare_method"`
+	ReadingSettings        bool              `toml:"reading_settings"`
+	ExtraRcloneArgs        []string          `toml:"extra_rclone_args"`
+	ButtonRefreshAfter     int               `toml:"button_refresh_after"`
+	ButtonReplugAfter      int               `toml:"button_replug_after"`
+	Env                    map[string]string `toml:"env"`
+	SingleRun              bool              `toml:"single_run"`
+	SeriesIndexPad         int               `toml:"series_index_pad"`
+	IgnoreExisting         bool              `toml:"ignore_existing"`
+	RemountTimeoutSec      int               `toml:"remount_timeout_sec"`
+	RescanAfterMetadata    bool              `toml:"rescan_after_metadata"`
+	RemoteConfig           string            `toml:"remote_config"`
+	FsckBeforeMount        bool              `toml:"fsck_before_mount"`
+	FallbackMatch          bool              `toml:"fallback_match"`
+	CommentsColumn         string            `toml:"comments_column"`
+	StripCommentsHTML      bool              `toml:"strip_comments_html"`
+	ConfigVersion          int               `toml:"config_version"`
+	MigrateConfig          bool              `toml:"migrate_config"`
+	ConfirmConnectScreen   bool              `toml:"confirm_connect_screen"`
+	BookStorage            string            `toml:"book_storage"`
+	OnlyChangedMetadata    bool              `toml:"only_changed_metadata"`
+	ExtractArchives        bool              `toml:"extract_archives"`
+	ButtonEventFile        string            `toml:"button_event_file"`
+	UnmountGraceMs         int               `toml:"unmount_grace_ms"`
+	UseRcd                 bool              `toml:"use_rcd"`
+	BookExtensions         []string          `toml:"book_extensions"`
+}
+
+// selectBookDir makes the i'th pair of book and remote dirs the ones in use.
+// A missing remote dir is the root of the remote.
+func (krCfg *KRcloneConfig) selectBookDir(i int) {
+	krCfg.KRbookDir, krCfg.RCrootDir = "", ""
+	if i < len(krCfg.BookDirs) {
+		krCfg.KRbookDir = krCfg.BookDirs[i]
+	}
+	if i < len(krCfg.RootDirs) {
+		krCfg.RCrootDir = krCfg.RootDirs[i]
+	}
+}
+
+// bookDirPair is a book dir on the device, with the config to sync it
+type bookDirPair struct {
+	cfg     KRcloneConfig
+	bookDir string
+	// stateDir holds the metadata state for this book dir. The first book dir
+	// uses the kobo-rclone directory, as when there is only one.
+	stateDir string
+}
+
+// defaultConfig returns the configuration used for any options missing from
+// the config file
+func defaultConfig() KRcloneConfig {
+	return KRcloneConfig{
+		MetadataFile:       ".metadata.calibre",
+		MinBatteryPercent:  20,
+		KepubKeepOriginal:  true,
+		CoverWorkers:       2,
+		RemountSettleMs:    500,
+		UnmountGraceMs:     1000,
+		SyncMode:           "sync",
+		RcloneLogLevel:     "INFO",
+		KoboDBPath:         ".kobo/KoboReader.sqlite",
+		BackupDB:           true,
+		ClearBetweenPhases: true,
+		MetadataFields:     []string{"description", "series", "seriesindex"},
+		StatusLines:        5,
+		Verbosity:          levelNormal,
+		KepubAware:         true,
+		CheckDBIntegrity:   true,
+		SpinnerStyle:       "classic",
+		CompareMethod:      "default",
+		ButtonRefreshAfter: 10,
+		ButtonReplugAfter:  40,
+		RemountTimeoutSec:  30,
+		CommentsColumn:     "Description",
+		BookExtensions:     bookExtensions,
+		BookStorage:        "onboard",
+		// Config files from before versioning don't have a version
+		ConfigVersion: 1,
+	}
+}
+
+// chkErrFatal logs the error, with the current phase and a stack trace to
+// make sense of it later, and restores the device. It then shows usrMsg to the
+// user for msgDuration seconds (or error_message_sec, if set), and exits.
+func chkErrFatal(p Printer, err error, usrMsg string, msgDuration int) {
+	if err != nil {
+		// Restoring the device may fail too, and the first error is the one
+		// worth reporting
+		if !atomic.CompareAndSwapInt32(&handlingFatal, 0, 1) {
+			log.Printf("error while handling a fatal error: %s", err)
+			return
+		}
+		phase, _ := currentPhase.Load().(string)
+		if phase == "" {
+			phase = "startup"
+		}
+		log.Printf("fatal error during %s: %s\n%s", phase, err, debug.Stack())
+		restoreDevice(p)
+		if usrMsg == "" {
+			usrMsg = "kobo-rclone stopped unexpectedly. See the log for details."
+		}
+		if errorMessageSec > 0 {
+			msgDuration = errorMessageSec
+		}
+		p.Println(usrMsg)
+		time.Sleep(time.Duration(msgDuration) * time.Second)
+		os.Exit(1)
+	}
+}
+
+// logErrPrint is a convenience function for logging errors
+func logErrPrint(err error) {
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// Printer displays status messages to the user
+type Printer interface {
+	Println(str string)
+	// PrintLastLn replaces the most recent line, which is useful for progress updates
+	PrintLastLn(str string)
+}
+
+// Display is a Printer that can also interact with Nickel's screen
+type Display interface {
+	Printer
+	Init() error
+	Open() error
+	Close() error
+	// Clear blanks the screen, and forgets any previous messages
+	Clear()
+	// Refresh redraws the screen with a full flash
+	Refresh()
+	// ButtonScan looks for Nickel's USB connect button, and presses it if
+	// pressButton is set. Failures are ErrButtonNotFound, ErrButtonPressFailed
+	// or ErrTouchFailed.
+	ButtonScan(pressButton bool) error
+}
+
+// fbinkDisplay prints status messages on the Kobo screen using FBInk
+type fbinkDisplay struct{}
+
+// Init initialises FBInk. It must be called before anything is printed.
+func (fbinkDisplay) Init() error {
+	fbinkOpts.IsQuiet = true
+	fbinkOpts.Fontmult = 3
+	if err := gofbink.Init(gofbink.FBFDauto, fbinkOpts); err != nil {
+		return err
+	}
+	var state gofbink.FBInkState
+	gofbink.GetState(&fbinkOpts, &state)
+	fbScreenRows = int(state.MaxRows) - fbFirstRow
+	return nil
+}
+
+// Open is a no-op, as FBInk opens the framebuffer itself on each call when
+// using FBFDauto
+func (fbinkDisplay) Open() error {
+	return nil
+}
+
+// Close is a no-op, see Open
+func (fbinkDisplay) Close() error {
+	return nil
+}
+
+// Println uses FBInk to print text on the Kobo screen
+func (fbinkDisplay) Println(str string) {
+	for fbMsgBuffer.Len() >= fbMaxLines {
+		elt := fbMsgBuffer.Front()
+		fbMsgBuffer.Remove(elt)
+	}
+	fbMsgBuffer.PushBack(str)
+	fbRedraw()
+}
+
+// Clear uses FBInk to clear the screen, and empties the message buffer
+func (fbinkDisplay) Clear() {
+	fbMsgBuffer.Init()
+	clsOpts := fbinkOpts
+	clsOpts.IsCleared = true
+	if _, err := gofbink.Print(gofbink.FBFDauto, " ", clsOpts); err != nil {
+		logErrPrint(err)
+	}
+}
+
+// PrintLastLn uses FBInk to replace the last line printed on the Kobo screen
+func (f fbinkDisplay) PrintLastLn(str string) {
+	if fbMsgBuffer.Len() == 0 {
+		f.Println(str)
+		return
+	}
+	fbMsgBuffer.Back().Value = str
+	fbRedraw()
+}
+
+// ButtonScan simulates pressing the touch screen to 'press' the 'connect' button
+// when 'plugging in' the usb cable.
+//
+// It replays events captured by /dev/input/event1, which are stored in a model specific
+// file. On models where the touchscreen is another device, that device stands in
+// for event1 while the button is pressed.
+func (fbinkDisplay) ButtonScan(pressButton bool) error {
+	if pressButton && touchDevice != touchEventDev {
+		if err := syscall.Mount(touchDevice, touchEventDev, "", syscall.MS_BIND, ""); err != nil {
+			logErrPrint(err)
+			return errors.New("touch event failure")
+		}
+		defer syscall.Unmount(touchEventDev, 0)
+	}
+	err := gofbink.ButtonScan(gofbink.FBFDauto, pressButton, false)
+	if err == nil {
+		return nil
+	}
+	switch err.Error() {
+	case "EXIT_FAILURE":
+		return ErrButtonNotFound
+	case "ENOTSUP":
+		return ErrButtonPressFailed
+	case "ENODEV":
+		return ErrTouchFailed
+	}
+	log.Printf("ignoring unexpected button scan result %s", err)
+	return nil
+}
+
+// Refresh redraws our messages with a flashing refresh, which on some firmware
+// is needed before the connect button can be found
+func (fbinkDisplay) Refresh() {
+	fbinkOpts.IsFlashing = true
+	fbRedraw()
+	fbinkOpts.IsFlashing = false
+}
+
+// fbRedraw prints the message buffer to the screen. Lines are padded so that
+// a shorter line fully replaces a longer one.
+func fbRedraw() {
+	fbinkOpts.Col = 1
+	fbinkOpts.IsPadded = true
+	row := int16(fbFirstRow)
+	for m := fbMsgBuffer.Front(); m != nil; m = m.Next() {
+		fbinkOpts.Row = row
+		rowsPrinted, err := gofbink.Print(gofbink.FBFDauto, m.Value.(string), fbinkOpts)
+		if err != nil {
+			// Most likely we've run off the bottom of the screen, so there's
+			// no point trying to print any more lines
+			logErrPrint(err)
+			break
+		}
+		row += int16(rowsPrinted)
+	}
+}
+
+// stdoutDisplay prints status messages to standard output, which is useful
+// when running off-device
+type stdoutDisplay struct{}
+
+// Init is a no-op for stdout
+func (stdoutDisplay) Init() error {
+	return nil
+}
+
+// Open is a no-op for stdout
+func (stdoutDisplay) Open() error {
+	return nil
+}
+
+// Close is a no-op for stdout
+func (stdoutDisplay) Close() error {
+	return nil
+}
+
+// Println prints text to standard output
+func (stdoutDisplay) Println(str string) {
+	fmt.Println(str)
+}
+
+// Clear is a no-op for stdout
+func (stdoutDisplay) Clear() {}
+
+// Refresh is a no-op for stdout
+func (stdoutDisplay) Refresh() {}
+
+// PrintLastLn prints text to standard output. Unlike the screen, earlier
+// lines are kept.
+func (stdoutDisplay) PrintLastLn(str string) {
+	fmt.Println(str)
+}
+
+// ButtonScan can't see the screen, so it assumes the button was pressed
+func (stdoutDisplay) ButtonScan(pressButton bool) error {
+	fmt.Println("(assuming connect button was found)")
+	return nil
+}
+
+// nopDisplay records status messages instead of showing them, so the
+// orchestration functions can be run headless, and their output inspected
+type nopDisplay struct {
+	Messages []string
+	// ButtonErr is returned by every call to ButtonScan
+	ButtonErr error
+}
+
+// Init is a no-op
+func (*nopDisplay) Init() error {
+	return nil
+}
+
+// Open is a no-op
+func (*nopDisplay) Open() error {
+	return nil
+}
+
+// Close is a no-op
+func (*nopDisplay) Close() error {
+	return nil
+}
+
+// Println records a message
+func (n *nopDisplay) Println(str string) {
+	n.Messages = append(n.Messages, str)
+}
+
+// Clear forgets all recorded messages
+func (n *nopDisplay) Clear() {
+	n.Messages = nil
+}
+
+// Refresh does nothing
+func (*nopDisplay) Refresh() {}
+
+// PrintLastLn replaces the last recorded message
+func (n *nopDisplay) PrintLastLn(str string) {
+	if len(n.Messages) == 0 {
+		n.Println(str)
+		return
+	}
+	n.Messages[len(n.Messages)-1] = str
+}
+
+// ButtonScan returns ButtonErr
+func (n *nopDisplay) ButtonScan(pressButton bool) error {
+	return n.ButtonErr
+}
+
+// Event is a status update from one of the phases of a run
+type Event struct {
+	Phase   string
+	Message string
+	// Fraction is the progress through the phase, from 0 to 1, or -1 if unknown
+	Fraction float64
+	// Replace indicates the message replaces the previous one
+	Replace bool
+	// Clear indicates the screen should be cleared
+	Clear bool
+	// Refresh indicates the screen should be redrawn with a full flash
+	Refresh bool
+}
+
+// eventDisplay is a Display that emits status messages as Events, instead of
+// showing them. This keeps presentation out of the orchestration functions.
+// Everything other than status messages is passed on to the wrapped Display.
+type eventDisplay struct {
+	Display
+	phase  string
+	events chan<- Event
+}
+
+// Println emits a message Event
+func (e *eventDisplay) Println(str string) {
+	e.events <- Event{Phase: e.phase, Message: str, Fraction: -1}
+}
+
+// PrintLastLn emits an Event replacing the previous message
+func (e *eventDisplay) PrintLastLn(str string) {
+	e.events <- Event{Phase: e.phase, Message: str, Fraction: -1, Replace: true}
+}
+
+// Progress emits an Event replacing the previous message, with the progress
+// through the phase
+func (e *eventDisplay) Progress(str string, fraction float64) {
+	e.events <- Event{Phase: e.phase, Message: str, Fraction: fraction, Replace: true}
+}
+
+// Clear emits an Event to clear the screen
+func (e *eventDisplay) Clear() {
+	e.events <- Event{Phase: e.phase, Fraction: -1, Clear: true}
+}
+
+// Refresh emits an Event to refresh the screen
+func (e *eventDisplay) Refresh() {
+	e.events <- Event{Phase: e.phase, Fraction: -1, Refresh: true}
+}
+
+// printLevel shows a status message, and logs it, if the verbosity is at least
+// level
+func printLevel(p Printer, level int, str string) {
+	if level > verbosity {
+		return
+	}
+	p.Println(str)
+	log.Print(str)
+}
+
+// printProgress shows a progress update, including the fraction complete if
+// the Printer can make use of it
+func printProgress(p Printer, str string, fraction float64) {
+	if pp, ok := p.(interface {
+		Progress(str string, fraction float64)
+	}); ok {
+		pp.Progress(str, fraction)
+		return
+	}
+	p.PrintLastLn(str)
+}
+
+// spinnerStyles are the animations available to the spinner_style config
+// option
+var spinnerStyles = map[string][]string{
+	"classic": {"|", "/", "-", "\\"},
+	"dots":    {".  ", ".. ", "..."},
+	"braille": {"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"},
+	"none":    nil,
+}
+
+// activitySpinner animates the last status line while a long running step,
+// which can't report its progress, is under way
+type activitySpinner struct {
+	p      Printer
+	mu     sync.Mutex
+	msg    string
+	frames []string
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// startSpinner prints msg, and animates it until Stop is called
+func startSpinner(p Printer, msg, style string) *activitySpinner {
+	frames, ok := spinnerStyles[style]
+	if !ok {
+		log.Printf("unknown spinner_style %q, using classic", style)
+		frames = spinnerStyles["classic"]
+	}
+	// Each frame would be a new line on stdout
+	if e, ok := p.(*eventDisplay); ok {
+		if _, onStdout := e.Display.(stdoutDisplay); onStdout {
+			frames = nil
+		}
+	}
+	s := &activitySpinner{p: p, msg: msg, frames: frames, stop: make(chan struct{}), done: make(chan struct{})}
+	p.Println(msg)
+	go s.run()
+	return s
+}
+
+func (s *activitySpinner) run() {
+	defer close(s.done)
+	if len(s.frames) == 0 {
+		<-s.stop
+		return
+	}
+	// The eInk screen is slow to refresh, so don't animate too quickly
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			msg := s.msg
+			s.mu.Unlock()
+			s.p.PrintLastLn(msg + " " + s.frames[i%len(s.frames)])
+		}
+	}
+}
+
+// SetMessage changes the spinner's message. Without an animation, the new
+// message is printed straight away.
+func (s *activitySpinner) SetMessage(msg string) {
+	s.mu.Lock()
+	changed := msg != s.msg
+	s.msg = msg
+	s.mu.Unlock()
+	if changed && len(s.frames) == 0 {
+		s.p.PrintLastLn(msg)
+	}
+}
+
+// Stop ends the animation, leaving the message on screen. Nothing is printed by
+// the spinner once Stop returns.
+func (s *activitySpinner) Stop() {
+	close(s.stop)
+	<-s.done
+	if len(s.frames) > 0 {
+		s.mu.Lock()
+		s.p.PrintLastLn(s.msg)
+		s.mu.Unlock()
+	}
+}
+
+// runPhase runs one phase of kobo-rclone in the background, rendering the
+// Events it emits on the Display until it finishes
+func runPhase(d Display, phase string, fn func(d Display) (int, error)) (int, error) {
+	events := make(chan Event, 16)
+	var count int
+	var err error
+	currentPhase.Store(phase)
+	go func() {
+		defer close(events)
+		count, err = fn(&eventDisplay{Display: d, phase: phase, events: events})
+	}()
+	for ev := range events {
+		switch {
+		case ev.Clear:
+			d.Clear()
+		case ev.Refresh:
+			d.Refresh()
+		case ev.Replace:
+			d.PrintLastLn(ev.Message)
+		default:
+			d.Println(ev.Message)
+		}
+	}
+	return count, err
+}
+
+// timePhase starts timing a phase or step. The returned function stops the
+// timer, logs and records the time taken, and returns it.
+func timePhase(name string) func() time.Duration {
+	start := time.Now()
+	return func() time.Duration {
+		elapsed := time.Since(start)
+		log.Printf("phase %s took %.1fs", name, elapsed.Seconds())
+		phaseTimings = append(phaseTimings, phaseTiming{name: name, elapsed: elapsed})
+		return elapsed
+	}
+}
+
+// setRunState records where we are in the sync/metadata lifecycle
+func setRunState(krcloneDir string, runState RunState) {
+	state := loadState(krcloneDir)
+	log.Printf("run state %s -> %s", state.RunState, runState)
+	state.RunState = runState
+	logErrPrint(saveState(krcloneDir, state))
+}
+
+// currentRunState reads the run state, moving anyone still using the old lock
+// file over to the state file
+func currentRunState(krcloneDir string) RunState {
+	lockPath := filepath.Join(krcloneDir, metaLockFile)
+	if _, err := os.Stat(lockPath); err == nil {
+		setRunState(krcloneDir, stateAwaitingMetadata)
+		logErrPrint(os.Remove(lockPath))
+	}
+	return loadState(krcloneDir).RunState
+}
+
+// loadState reads the persistent state file. A missing or unreadable state
+// file results in an empty state.
+func loadState(krcloneDir string) KRcloneState {
+	var state KRcloneState
+	stateJSON, err := ioutil.ReadFile(filepath.Join(krcloneDir, stateFile))
+	if err == nil {
+		logErrPrint(json.Unmarshal(stateJSON, &state))
+	}
+	if state.MetadataHashes == nil {
+		state.MetadataHashes = make(map[string]string)
+	}
+	if state.LastSeen == nil {
+		state.LastSeen = make(map[string]time.Time)
+	}
+	if state.RunState == "" {
+		state.RunState = stateIdle
+	}
+	return state
+}
+
+// saveState writes the persistent state file
+func saveState(krcloneDir string, state KRcloneState) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(krcloneDir, stateFile), stateJSON, 0644)
+}
+
+// diffState compares the metadata against the state, returning the lpaths of
+// books whose metadata has changed (or are new), and of books the state knows
+// about that are no longer in the metadata
+func diffState(state KRcloneState, metadata []BookMetadata) (changed, removed []string) {
+	current := make(map[string]bool)
+	for _, meta := range metadata {
+		if meta.Lpath == "" {
+			continue
+		}
+		current[meta.Lpath] = true
+		if state.MetadataHashes[meta.Lpath] != metadataHash(meta) {
+			changed = append(changed, meta.Lpath)
+		}
+	}
+	for lpath := range state.MetadataHashes {
+		if !current[lpath] {
+			removed = append(removed, lpath)
+		}
+	}
+	for lpath := range state.LastSeen {
+		if _, ok := state.MetadataHashes[lpath]; !ok && !current[lpath] {
+			removed = append(removed, lpath)
+		}
+	}
+	return changed, removed
+}
+
+// markSeen records that every book in the metadata was seen at time t
+func markSeen(state *KRcloneState, metadata []BookMetadata, t time.Time) {
+	for _, meta := range metadata {
+		if meta.Lpath != "" {
+			state.LastSeen[meta.Lpath] = t
+		}
+	}
+}
+
+// forgetBooks removes books from the state, so it doesn't grow forever as
+// books come and go
+func forgetBooks(state *KRcloneState, lpaths []string) {
+	for _, lpath := range lpaths {
+		delete(state.MetadataHashes, lpath)
+		delete(state.LastSeen, lpath)
+	}
+}
+
+// metadataHash returns a hash of a book's metadata and the metadataSettings, so
+// we can tell if it has changed since we last wrote it to the DB
+func metadataHash(meta BookMetadata) string {
+	metaJSON, _ := json.Marshal(meta)
+	sum := sha1.Sum(append([]byte(metadataSettings), metaJSON...))
+	return hex.EncodeToString(sum[:])
+}
+
+// describeMetadataSettings lists the options that change what the metadata
+// update writes, in a stable order. The order of metadata_fields doesn't
+// matter.
+func describeMetadataSettings(fieldNames []string, pad int, stripHTML bool, commentsColumn string) string {
+	fields := make([]string, len(fieldNames))
+	for i, name := range fieldNames {
+		fields[i] = strings.ToLower(name)
+	}
+	sort.Strings(fields)
+	return fmt.Sprintf("fields=%s pad=%d strip_html=%t comments_column=%s\n", strings.Join(fields, ","), pad, stripHTML, commentsColumn)
+}
+
+// encodeLpath URL-encodes each segment of a Calibre lpath (or ContentID), to
+// match the way Nickel encodes some ContentIDs. Eg: "My Books/Café.epub"
+// becomes "My%20Books/Caf%C3%A9.epub"
+func encodeLpath(lpath string) string {
+	segments := strings.Split(filepath.ToSlash(lpath), "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// writeResult records the outcome of the run in the result file
+func writeResult(krcloneDir, phase string, start time.Time, booksUpdated int, runErr error) {
+	result := RunResult{
+		Phase:        phase,
+		OK:           runErr == nil,
+		BooksUpdated: booksUpdated,
+		DurationSec:  int(time.Since(start).Seconds()),
+		// Helps when diagnosing bug reports from an old rclone
+		RcloneVersion: rcloneVersion,
+	}
+	if len(phaseTimings) > 0 {
+		result.Timings = make(map[string]float64)
+		for _, t := range phaseTimings {
+			result.Timings[t.name] += math.Round(t.elapsed.Seconds()*10) / 10
+		}
+	}
+	if runErr != nil {
+		result.Error = runErr.Error()
+	}
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logErrPrint(err)
+		return
+	}
+	logErrPrint(ioutil.WriteFile(filepath.Join(krcloneDir, resultFile), resultJSON, 0644))
+}
+
+// lpathContentID computes the ContentID Nickel gives a book, from its Calibre
+// lpath. The lpath may include subdirectories, which rclone mirrors from the
+// remote. Eg: "Author/Series/Book.epub" in the "krclone-books" book directory
+// becomes "file:///mnt/onboard/krclone-books/Author/Series/Book.epub", or
+// "file:///mnt/sd/krclone-books/Author/Series/Book.epub" on the SD card. The
+// prefix comes from ksDir, which is under the configured storage's mountpoint.
+func lpathContentID(ksDir, lpath string) string {
+	return "file://" + filepath.ToSlash(filepath.Join(ksDir, lpath))
+}
+
+// loadIgnorePatterns reads the glob patterns from the ignore file in the book
+// directory. Blank lines and lines starting with "#" are skipped, as rclone
+// does.
+func loadIgnorePatterns(ksDir string) []string {
+	ignoreData, err := ioutil.ReadFile(filepath.Join(ksDir, krIgnoreFile))
+	if err != nil {
+		return nil
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(ignoreData), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns
+}
+
+// ignoredBook checks whether a book's lpath matches any of the ignore
+// patterns. As with rclone, a pattern starting with "/" matches from the top
+// of the book directory, and a pattern without a "/" matches the file name in
+// any directory.
+func ignoredBook(lpath string, patterns []string) bool {
+	lpath = filepath.ToSlash(lpath)
+	for _, pattern := range patterns {
+		name := lpath
+		if strings.HasPrefix(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+		} else if !strings.Contains(pattern, "/") {
+			name = path.Base(lpath)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// kepubLpath returns the lpath a book would have after being converted to a
+// kepub, or "" if it isn't an epub
+func kepubLpath(lpath string) string {
+	lower := strings.ToLower(lpath)
+	if !strings.HasSuffix(lower, ".epub") || strings.HasSuffix(lower, ".kepub.epub") {
+		return ""
+	}
+	return lpath[:len(lpath)-len(".epub")] + ".kepub.epub"
+}
+
+// storageMount returns the mountpoint of the storage the book dir is on
+func storageMount(storage string) (string, error) {
+	switch storage {
+	case "onboard":
+		return onboardMnt, nil
+	case "sd":
+		return sdMnt, nil
+	}
+	return "", fmt.Errorf("invalid book_storage %q", storage)
+}
+
+// resolvePath returns path unchanged if it is absolute, otherwise it is treated
+// as relative to baseDir
+func resolvePath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// bookExtensions are the file types treated as books, from the book_extensions
+// config option. Each is lower case, with a leading dot.
+var bookExtensions = []string{".epub", ".kepub.epub", ".pdf", ".mobi", ".cbz", ".cbr", ".txt", ".html", ".htm", ".rtf"}
+
+// isBookFile checks whether path looks like a book. Hidden files, such as the
+// Calibre metadata file and macOS "._" resource forks, are not books.
+func isBookFile(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	// Extensions may have more than one part, eg: ".kepub.epub"
+	name = strings.ToLower(name)
+	for _, bookExt := range bookExtensions {
+		if strings.HasSuffix(name, bookExt) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkBooks calls fn for every book in the book directory. Hidden directories,
+// and the .sdr directories some readers keep alongside books, are skipped.
+func walkBooks(ksDir string, fn func(path string, info os.FileInfo)) {
+	filepath.Walk(ksDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != ksDir && (strings.HasPrefix(info.Name(), ".") || strings.HasSuffix(info.Name(), ".sdr")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isBookFile(path) {
+			fn(path, info)
+		}
+		return nil
+	})
+}
+
+// snapshotBookDir records the modification time of every book in the book
+// directory, so we can later tell which books a sync added or changed
+func snapshotBookDir(ksDir string) map[string]time.Time {
+	files := make(map[string]time.Time)
+	walkBooks(ksDir, func(path string, info os.FileInfo) {
+		files[path] = info.ModTime()
+	})
+	return files
+}
+
+// countBookFiles counts the books in the book directory
+func countBookFiles(ksDir string) int {
+	count := 0
+	walkBooks(ksDir, func(path string, info os.FileInfo) {
+		count++
+	})
+	return count
+}
+
+// changedFiles returns the files in after that are not in before, or that
+// have been modified since before was taken
+func changedFiles(before, after map[string]time.Time) []string {
+	var changed []string
+	for path, modTime := range after {
+		if prevModTime, ok := before[path]; !ok || !prevModTime.Equal(modTime) {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// isArchive checks whether path is an archive that may contain books
+func isArchive(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// extractBook writes a book from an archive into destDir. Directories inside
+// the archive are flattened, which also stops an entry escaping destDir. A book
+// with the same name and size is assumed to have been extracted already, and
+// other name collisions get a number added, eg: "Book (1).epub".
+func extractBook(destDir, name string, size int64, r io.Reader) (string, error) {
+	name = filepath.Base(filepath.FromSlash(name))
+	ext := filepath.Ext(name)
+	bookPath := filepath.Join(destDir, name)
+	for i := 1; ; i++ {
+		info, err := os.Stat(bookPath)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err == nil && info.Size() == size {
+			return bookPath, nil
+		}
+		bookPath = filepath.Join(destDir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	bookFile, err := os.OpenFile(bookPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(bookFile, r); err != nil {
+		bookFile.Close()
+		os.Remove(bookPath)
+		return "", err
+	}
+	return bookPath, bookFile.Close()
+}
+
+// extractZip extracts the books in a zip archive, returning their paths
+func extractZip(archivePath string) ([]string, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var books []string
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !isBookFile(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return books, err
+		}
+		bookPath, err := extractBook(filepath.Dir(archivePath), f.Name, int64(f.UncompressedSize64), rc)
+		rc.Close()
+		if err != nil {
+			return books, err
+		}
+		books = append(books, bookPath)
+	}
+	return books, nil
+}
+
+// extractTarGz extracts the books in a gzipped tar archive, returning their
+// paths
+func extractTarGz(archivePath string) ([]string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gzReader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+	tr := tar.NewReader(gzReader)
+	var books []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return books, nil
+		}
+		if err != nil {
+			return books, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !isBookFile(hdr.Name) {
+			continue
+		}
+		bookPath, err := extractBook(filepath.Dir(archivePath), hdr.Name, hdr.Size, tr)
+		if err != nil {
+			return books, err
+		}
+		books = append(books, bookPath)
+	}
+}
+
+// filterEscape escapes the characters rclone treats as special in filter
+// patterns
+func filterEscape(str string) string {
+	var b strings.Builder
+	for _, r := range str {
+		if strings.ContainsRune(`\*?[]{}`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// extractArchives extracts the books from any archives in the book dir, then
+// removes the archives. Archives without any books in them are left alone. The
+// archives and their books are recorded in the extracted file.
+func extractArchives(p Printer, ksDir, krcloneDir string) {
+	var archives []string
+	filepath.Walk(ksDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && isArchive(path) {
+			archives = append(archives, path)
+		}
+		return nil
+	})
+	var rules []string
+	for _, archivePath := range archives {
+		printLevel(p, levelNormal, "Extracting "+filepath.Base(archivePath))
+		var books []string
+		var err error
+		if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+			books, err = extractZip(archivePath)
+		} else {
+			books, err = extractTarGz(archivePath)
+		}
+		if err != nil {
+			// Leave the archive to try again next time
+			log.Printf("extracting %s failed: %s", archivePath, err)
+			continue
+		}
+		if len(books) == 0 {
+			log.Printf("skipping %s, it has no books in it", archivePath)
+			continue
+		}
+		log.Printf("extracted %d books from %s", len(books), archivePath)
+		logErrPrint(os.Remove(archivePath))
+		for _, path := range append(books, archivePath) {
+			rel, _ := filepath.Rel(ksDir, path)
+			rules = append(rules, "/"+filterEscape(filepath.ToSlash(rel)))
+		}
+	}
+	logErrPrint(appendFilterRules(filepath.Join(krcloneDir, extractedFile), rules))
+}
+
+// appendFilterRules adds rclone filter rules to the end of a rules file,
+// creating it if needed
+func appendFilterRules(rulesPath string, rules []string) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(rulesPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(rules, "\n") + "\n")
+	return err
+}
+
+// kepubifyBooks converts any newly synced epubs to kepubs using the kepubify
+// program. Failures are logged, but do not stop the remaining conversions.
+func kepubifyBooks(p Printer, kepubifyBin, ksDir, krcloneDir string, books []string, keepOriginal bool) {
+	var rules []string
+	for _, book := range books {
+		lowerBook := strings.ToLower(book)
+		if !isBookFile(book) || !strings.HasSuffix(lowerBook, ".epub") || strings.HasSuffix(lowerBook, ".kepub.epub") {
+			continue
+		}
+		printLevel(p, levelNormal, "Converting "+filepath.Base(book))
+		dir, _ := filepath.Split(book)
+		convCmd := exec.Command(kepubifyBin, "-o", dir, book)
+		if out, err := convCmd.CombinedOutput(); err != nil {
+			log.Printf("kepubify failed for %s: %s: %s", book, err, out)
+			continue
+		}
+		if !keepOriginal {
+			if err := os.Remove(book); err != nil {
+				logErrPrint(err)
+				continue
+			}
+			rel, _ := filepath.Rel(ksDir, book)
+			rules = append(rules, "/"+filterEscape(filepath.ToSlash(rel)))
+		}
+	}
+	logErrPrint(appendFilterRules(filepath.Join(krcloneDir, convertedFile), rules))
+}
+
+// pruneKepubs removes kepubs whose epub is no longer in the book directory. In
+// sync mode rclone deletes books removed from the remote, but not the kepubs
+// made from them, as kepubs are excluded from the sync. It returns how many
+// were removed.
+func pruneKepubs(ksDir string) int {
+	files := make(map[string]bool)
+	var kepubs []string
+	filepath.Walk(ksDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		files[strings.ToLower(path)] = true
+		if strings.HasSuffix(strings.ToLower(path), ".kepub.epub") {
+			kepubs = append(kepubs, path)
+		}
+		return nil
+	})
+	removed := 0
+	for _, kepub := range kepubs {
+		epub := strings.ToLower(kepub[:len(kepub)-len(".kepub.epub")]) + ".epub"
+		if files[epub] {
+			continue
+		}
+		if err := os.Remove(kepub); err != nil {
+			logErrPrint(err)
+			continue
+		}
+		log.Printf("removed %s, as its epub is gone", kepub)
+		removed++
+	}
+	return removed
+}
+
+// coverSize is one of the thumbnails Nickel keeps for each book in the
+// .kobo-images directory
+type coverSize struct {
+	suffix        string
+	width, height int
+}
+
+// coverSizes are the library thumbnails generated for new books. Nickel makes
+// the full screen cover itself, as its size depends on the model.
+var coverSizes = []coverSize{
+	{" - N3_LIBRARY_FULL.parsed", 355, 473},
+	{" - N3_LIBRARY_GRID.parsed", 149, 198},
+}
+
+// coverImageDir returns the directory Nickel keeps a book's thumbnails in,
+// under imagesDir, and the ImageId they are named after. The directory is
+// picked by Qt's qHash of the ImageId.
+func coverImageDir(imagesDir, contentID string) (string, string) {
+	imageID := strings.NewReplacer("/", "_", " ", "_", ":", "_", ".", "_").Replace(contentID)
+	var h uint32
+	for _, c := range []byte(imageID) {
+		h = (h << 4) + uint32(c)
+		h ^= (h & 0xf0000000) >> 23
+		h &= 0x0fffffff
+	}
+	return filepath.Join(imagesDir, strconv.Itoa(int(h&0xff)), strconv.Itoa(int((h&0xff00)>>8))), imageID
+}
+
+// readZipFile reads a file from a zip archive
+func readZipFile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name == name {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		}
+	}
+	return nil, fmt.Errorf("%s not found", name)
+}
+
+// epubCover decodes the cover image of an epub. The cover is the manifest
+// item marked as the cover image (EPUB 3), or named by the cover meta
+// (EPUB 2).
+func epubCover(bookPath string) (image.Image, error) {
+	zr, err := zip.OpenReader(bookPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	containerXML, err := readZipFile(&zr.Reader, "META-INF/container.xml")
+	if err != nil {
+		return nil, err
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(containerXML, &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, errors.New("no OPF file in container.xml")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	opfXML, err := readZipFile(&zr.Reader, opfPath)
+	if err != nil {
+		return nil, err
+	}
+	var opf struct {
+		Meta []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"metadata>meta"`
+		Items []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"manifest>item"`
+	}
+	if err := xml.Unmarshal(opfXML, &opf); err != nil {
+		return nil, err
+	}
+	var coverID string
+	for _, meta := range opf.Meta {
+		if meta.Name == "cover" {
+			coverID = meta.Content
+		}
+	}
+	var href string
+	for _, item := range opf.Items {
+		if strings.Contains(" "+item.Properties+" ", " cover-image ") || (href == "" && item.ID == coverID) {
+			href = item.Href
+		}
+	}
+	if href == "" {
+		return nil, errors.New("no cover image")
+	}
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	imgData, err := readZipFile(&zr.Reader, path.Join(path.Dir(opfPath), href))
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	return img, err
+}
+
+// scaleImage resizes img to fit within width x height, keeping its aspect ratio
+func scaleImage(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	if b.Dx()*height > b.Dy()*width {
+		height = b.Dy() * width / b.Dx()
+	} else {
+		width = b.Dx() * height / b.Dy()
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*b.Dx()/width, b.Min.Y+y*b.Dy()/height))
+		}
+	}
+	return dst
+}
+
+// generateCover writes the library thumbnails for a book, unless Nickel (or a
+// previous run) already made them
+func generateCover(imagesDir, contentID, bookPath string) error {
+	coverDir, imageID := coverImageDir(imagesDir, contentID)
+	if _, err := os.Stat(filepath.Join(coverDir, imageID+coverSizes[0].suffix)); err == nil {
+		return nil
+	}
+	img, err := epubCover(bookPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(coverDir, 0755); err != nil {
+		return err
+	}
+	for _, size := range coverSizes {
+		f, err := os.Create(filepath.Join(coverDir, imageID+size.suffix))
+		if err != nil {
+			return err
+		}
+		err = jpeg.Encode(f, scaleImage(img, size.width, size.height), nil)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateCovers makes the library thumbnails for newly synced epubs, so
+// Nickel doesn't have to when it imports them. Covers are generated by a pool
+// of workers, reading books from a channel. Progress updates are serialised
+// with a mutex, as the screen can only show one at a time. It returns how
+// many books had covers generated.
+func generateCovers(p Printer, imagesDir, ksDir string, books []string, workers int) int {
+	var epubs []string
+	for _, book := range books {
+		if strings.HasSuffix(strings.ToLower(book), ".epub") {
+			epubs = append(epubs, book)
+		}
+	}
+	if len(epubs) == 0 {
+		return 0
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	printLevel(p, levelNormal, "Generating covers...")
+	jobs := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done, generated := 0, 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for book := range jobs {
+				lpath, _ := filepath.Rel(ksDir, book)
+				err := generateCover(imagesDir, lpathContentID(ksDir, lpath), book)
+				mu.Lock()
+				done++
+				if err != nil {
+					log.Printf("no cover for %s: %s", book, err)
+				} else {
+					generated++
+				}
+				printProgress(p, fmt.Sprintf("Covers %d/%d", done, len(epubs)), float64(done)/float64(len(epubs)))
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, book := range epubs {
+		jobs <- book
+	}
+	close(jobs)
+	wg.Wait()
+	printLevel(p, levelNormal, fmt.Sprintf("Generated covers for %d of %d books", generated, len(epubs)))
+	return generated
+}
+
+// checkRcloneBin makes sure the rclone binary exists, and can be run
+func checkRcloneBin(rcBin string) error {
+	binInfo, err := os.Stat(rcBin)
+	if err != nil {
+		return errors.New("rclone binary not found - see install docs")
+	}
+	if binInfo.IsDir() || binInfo.Mode()&0111 == 0 {
+		return errors.New("rclone binary is not executable - see install docs")
+	}
+	return nil
+}
+
+// checkRcloneFiles makes sure the rclone binary and its config file exist, as
+// these are the most common things to go wrong when first setting up
+func checkRcloneFiles(rcBin, rcConf string) error {
+	if err := checkRcloneBin(rcBin); err != nil {
+		return err
+	}
+	if _, err := os.Stat(rcConf); err != nil {
+		return errors.New("rclone config not found - see install docs")
+	}
+	return nil
+}
+
+// detectRcloneVersion runs "rclone version", returning the version it reports,
+// eg: "1.53.3"
+func detectRcloneVersion(rcBin string) (string, error) {
+	out, err := exec.Command(rcBin, "version").Output()
+	if err != nil {
+		return "", err
+	}
+	match := rcloneVersionRegex.FindStringSubmatch(string(out))
+	if match == nil {
+		return "", errors.New("could not parse rclone version")
+	}
+	return strings.TrimPrefix(match[0], "rclone v"), nil
+}
+
+// versionAtLeast compares two "major.minor[.patch]" versions
+func versionAtLeast(version, minimum string) bool {
+	v := strings.Split(version, ".")
+	m := strings.Split(minimum, ".")
+	for i := 0; i < len(m); i++ {
+		var vn, mn int
+		if i < len(v) {
+			vn, _ = strconv.Atoi(v[i])
+		}
+		mn, _ = strconv.Atoi(m[i])
+		if vn != mn {
+			return vn > mn
+		}
+	}
+	return true
+}
+
+// nickelEnv returns the value of an environment variable Nickel was started
+// with. Model specific settings such as the WiFi module are only set there.
+func nickelEnv(key string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	procDirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, procDir := range procDirs {
+		comm, err := ioutil.ReadFile(filepath.Join(procDir, "comm"))
+		if err != nil || strings.TrimSpace(string(comm)) != "nickel" {
+			continue
+		}
+		environ, err := ioutil.ReadFile(filepath.Join(procDir, "environ"))
+		if err != nil {
+			return ""
+		}
+		for _, kv := range strings.Split(string(environ), "\x00") {
+			if strings.HasPrefix(kv, key+"=") {
+				return strings.TrimPrefix(kv, key+"=")
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// wifiConnected checks whether the WiFi interface has an IPv4 address
+func wifiConnected(iface string) bool {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// wifiUp loads the WiFi drivers, associates using Nickel's wpa_supplicant config
+// and waits until we have an IP address. This mirrors what Nickel does itself.
+func wifiUp(iface, platform, module string, approxTimeout int) error {
+	cmds := [][]string{
+		{"insmod", filepath.Join("/drivers", platform, "wifi/sdio_wifi_pwr.ko")},
+		{"insmod", filepath.Join("/drivers", platform, "wifi", module+".ko")},
+		{"ifconfig", iface, "up"},
+		{"wlarm_le", "-i", iface, "up"},
+		{"wpa_supplicant", "-D", "wext", "-s", "-i", iface, "-O", "/var/run/wpa_supplicant", "-c", "/etc/wpa_supplicant/wpa_supplicant.conf", "-B"},
+		{"udhcpc", "-S", "-i", iface, "-s", "/etc/udhcpc.d/default.script", "-t15", "-T10", "-A3", "-b", "-q"},
+	}
+	for _, c := range cmds {
+		// Not every step applies to every model (eg: wlarm_le), so just log failures
+		if out, err := exec.Command(c[0], c[1:]...).CombinedOutput(); err != nil {
+			log.Printf("%s failed: %s: %s", c[0], err, out)
+		}
+	}
+	iterations := (approxTimeout * 1000) / 250
+	for i := 0; i < iterations; i++ {
+		if wifiConnected(iface) {
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return errors.New("wifi did not connect")
+}
+
+// wifiDown reverses wifiUp
+func wifiDown(iface, module string) {
+	cmds := [][]string{
+		{"killall", "udhcpc", "wpa_supplicant"},
+		{"wlarm_le", "-i", iface, "down"},
+		{"ifconfig", iface, "down"},
+		{"rmmod", module},
+		{"rmmod", "sdio_wifi_pwr"},
+	}
+	for _, c := range cmds {
+		if out, err := exec.Command(c[0], c[1:]...).CombinedOutput(); err != nil {
+			log.Printf("%s failed: %s: %s", c[0], err, out)
+		}
+	}
+}
+
+// batteryCapacityPath finds the sysfs file reporting the battery level, which
+// varies by model (eg: mc13892_bat, battery)
+func batteryCapacityPath() string {
+	supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+	for _, supply := range supplies {
+		supplyType, err := ioutil.ReadFile(filepath.Join(supply, "type"))
+		if err == nil && strings.TrimSpace(string(supplyType)) == "Battery" {
+			return filepath.Join(supply, "capacity")
+		}
+	}
+	return "/sys/class/power_supply/mc13892_bat/capacity"
+}
+
+// batteryLevel returns the battery charge as a percentage
+func batteryLevel(capacityPath string) (int, error) {
+	capacity, err := ioutil.ReadFile(capacityPath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(capacity)))
+}
+
+// detectTouchDevice searches the input devices for the touchscreen, which isn't
+// event1 on every model. It falls back to event1 if nothing is found.
+func detectTouchDevice() string {
+	devices, err := ioutil.ReadFile("/proc/bus/input/devices")
+	if err != nil {
+		logErrPrint(err)
+		return touchEventDev
+	}
+	// Each device is described by a block of lines, separated by a blank line.
+	// The touchscreen is the one reporting absolute axes.
+	for _, block := range strings.Split(string(devices), "\n\n") {
+		handler, hasAbs := "", false
+		for _, line := range strings.Split(block, "\n") {
+			if strings.HasPrefix(line, "H: Handlers=") {
+				for _, h := range strings.Fields(strings.TrimPrefix(line, "H: Handlers=")) {
+					if strings.HasPrefix(h, "event") {
+						handler = h
+					}
+				}
+			} else if strings.HasPrefix(line, "B: ABS=") && strings.Trim(strings.TrimPrefix(line, "B: ABS="), "0 ") != "" {
+				hasAbs = true
+			}
+		}
+		if hasAbs && handler != "" {
+			return filepath.Join("/dev/input", handler)
+		}
+	}
+	return touchEventDev
+}
+
+// waitForTap waits for the user to touch the screen. It returns false if
+// nothing happened before the timeout.
+func waitForTap(touchEventDevice string, approxTimeout int) bool {
+	touchDev, err := os.Open(touchEventDevice)
+	if err != nil {
+		logErrPrint(err)
+		return false
+	}
+	defer touchDev.Close()
+	tapped := make(chan bool, 1)
+	go func() {
+		// Any input event at all is a tap as far as we're concerned
+		ev := make([]byte, 16)
+		_, err := touchDev.Read(ev)
+		tapped <- err == nil
+	}()
+	select {
+	case t := <-tapped:
+		return t
+	case <-time.After(time.Duration(approxTimeout) * time.Second):
+		return false
+	}
+}
+
+// startWifi brings WiFi up if we are managing it, and it isn't already
+// connected. The returned function brings it back down again.
+func startWifi(p Printer, krCfg *KRcloneConfig) (func(), error) {
+	wifiIface := nickelEnv("INTERFACE")
+	if wifiIface == "" {
+		wifiIface = "eth0"
+	}
+	wifiModule := nickelEnv("WIFI_MODULE")
+	if !krCfg.ManageWifi || wifiConnected(wifiIface) {
+		return func() {}, nil
+	}
+	printLevel(p, levelNormal, "Enabling WiFi... Please wait.")
+	if err := wifiUp(wifiIface, nickelEnv("PLATFORM"), wifiModule, 30); err != nil {
+		logErrPrint(err)
+		wifiDown(wifiIface, wifiModule)
+		p.Println("WiFi did not connect. Aborting!")
+		return nil, err
+	}
+	printLevel(p, levelNormal, "WiFi connected.")
+	return func() { wifiDown(wifiIface, wifiModule) }, nil
+}
+
+// remotePath builds an rclone path to a file or directory on the remote,
+// relative to the configured root directory
+func remotePath(krCfg *KRcloneConfig, path string) string {
+	rcRemote := krCfg.RCremoteName
+	if !strings.HasSuffix(rcRemote, ":") {
+		rcRemote += ":"
+	}
+	return rcRemote + filepath.ToSlash(filepath.Join(krCfg.RCrootDir, path))
+}
+
+// pullMetadataFile downloads just the Calibre metadata file from the remote,
+// without touching any books
+func pullMetadataFile(p Printer, rcBin, rcConf, ksDir string, krCfg *KRcloneConfig) error {
+	mdPath := resolvePath(ksDir, krCfg.MetadataFile)
+	remoteMD := krCfg.MetadataFile
+	if filepath.IsAbs(remoteMD) {
+		remoteMD = filepath.Base(remoteMD)
+	}
+	stopWifi, err := startWifi(p, krCfg)
+	if err != nil {
+		return err
+	}
+	defer stopWifi()
+	printLevel(p, levelNormal, "Fetching metadata file... Please wait.")
+	copyCmd := exec.Command(rcBin, "copyto", remotePath(krCfg, remoteMD), mdPath, "--config", rcConf, "--ask-password=false")
+	copyCmd.Env = rcloneEnv(krCfg)
+	if out, err := copyCmd.CombinedOutput(); err != nil {
+		log.Printf("metadata file download failed: %s: %s", err, redact(string(out), secrets(krCfg)))
+		return err
+	}
+	return nil
+}
+
+// validateConfig checks the options that would otherwise only be caught part
+// way through a run
+func validateConfig(krCfg *KRcloneConfig) error {
+	if krCfg.SyncMode != "sync" && krCfg.SyncMode != "copy" && krCfg.SyncMode != "mount" {
+		return fmt.Errorf("invalid sync_mode %q", krCfg.SyncMode)
+	}
+	switch krCfg.CompareMethod {
+	case "default", "checksum", "size-only":
+	default:
+		return fmt.Errorf("invalid compare_method %q", krCfg.CompareMethod)
+	}
+	if krCfg.MaxAge != "" && !maxAgeRegex.MatchString(krCfg.MaxAge) {
+		return fmt.Errorf("invalid max_age %q", krCfg.MaxAge)
+	}
+	if _, err := storageMount(krCfg.BookStorage); err != nil {
+		return err
+	}
+	if _, _, err := buildUpdateSQL(krCfg.MetadataFields); err != nil {
+		return err
+	}
+	if krCfg.RCremoteName == "" {
+		return errors.New("rclone_remote_name is not set")
+	}
+	if len(krCfg.BookDirs) > 1 && len(krCfg.RootDirs) != len(krCfg.BookDirs) {
+		return fmt.Errorf("krclone_book_dir has %d dirs, but rclone_root_dir has %d", len(krCfg.BookDirs), len(krCfg.RootDirs))
+	}
+	return nil
+}
+
+// migrateConfig brings a config file from an older version up to date. The
+// defaults for any new options are already in krCfg, as the file is decoded
+// over them. If migrate_config is set, the file is also rewritten with the new
+// options added, commented out, and the original kept as a backup.
+func migrateConfig(cfgPath string, md toml.MetaData, krCfg *KRcloneConfig) error {
+	fromVersion := krCfg.ConfigVersion
+	if fromVersion >= configVersion {
+		return nil
+	}
+	krCfg.ConfigVersion = configVersion
+	log.Printf("config migrated from v%d to v%d", fromVersion, configVersion)
+	if !krCfg.MigrateConfig {
+		return nil
+	}
+	cfgData, err := ioutil.ReadFile(cfgPath)
+	if err != nil {
+		return err
+	}
+	var defaults bytes.Buffer
+	if err := toml.NewEncoder(&defaults).Encode(defaultConfig()); err != nil {
+		return err
+	}
+	var added []string
+	for _, line := range strings.Split(defaults.String(), "\n") {
+		// Tables come after the plain options
+		if strings.HasPrefix(line, "[") {
+			break
+		}
+		key := strings.TrimSpace(strings.SplitN(line, "=", 2)[0])
+		if key == "" || key == "config_version" || md.IsDefined(key) {
+			continue
+		}
+		added = append(added, "# "+line)
+	}
+	cfgStr := string(cfgData)
+	versionLine := fmt.Sprintf("config_version = %d", configVersion)
+	if md.IsDefined("config_version") {
+		cfgStr = configVersionRegex.ReplaceAllString(cfgStr, versionLine)
+	} else {
+		cfgStr = "# The config file version. Don't change this.\n" + versionLine + "\n" + cfgStr
+	}
+	if len(added) > 0 {
+		block := fmt.Sprintf("# Options added since config version %d, with their defaults\n%s\n", fromVersion, strings.Join(added, "\n"))
+		// Keep the new options out of any table, such as [env]
+		if loc := tableHeaderRegex.FindStringIndex(cfgStr); loc != nil {
+			cfgStr = cfgStr[:loc[0]] + block + cfgStr[loc[0]:]
+		} else {
+			if !strings.HasSuffix(cfgStr, "\n") {
+				cfgStr += "\n"
+			}
+			cfgStr += block
+		}
+	}
+	if err := ioutil.WriteFile(cfgPath+".bak", cfgData, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfgPath, []byte(cfgStr), 0644)
+}
+
+// fetchRemoteConfig downloads a config file from the remote, and merges it
+// over the local config. Options that refer to files on the device are kept
+// from the local config. If anything goes wrong, the local config is left as
+// it was.
+func fetchRemoteConfig(p Printer, krcloneDir string, krCfg *KRcloneConfig) error {
+	rcBin := filepath.Join(krcloneDir, "rclone")
+	rcConf := filepath.Join(krcloneDir, krCfg.RcloneCfg)
+	if err := checkRcloneFiles(rcBin, rcConf); err != nil {
+		return err
+	}
+	stopWifi, err := startWifi(p, krCfg)
+	if err != nil {
+		return err
+	}
+	defer stopWifi()
+	printLevel(p, levelNormal, "Fetching remote config... Please wait.")
+	// A full rclone path may be given, otherwise it is relative to the remote dir
+	remoteCfg := krCfg.RemoteConfig
+	if !strings.Contains(remoteCfg, ":") {
+		remoteCfg = remotePath(krCfg, remoteCfg)
+	}
+	cfgPath := filepath.Join(krcloneDir, "krclone-cfg.remote.toml")
+	copyCmd := exec.Command(rcBin, "copyto", remoteCfg, cfgPath, "--config", rcConf, "--ask-password=false")
+	copyCmd.Env = rcloneEnv(krCfg)
+	if out, err := copyCmd.CombinedOutput(); err != nil {
+		log.Printf("remote config download failed: %s: %s", err, redact(string(out), secrets(krCfg)))
+		return err
+	}
+	merged := *krCfg
+	// Don't let a failed merge change the local [env] section
+	merged.Env = make(map[string]string)
+	for key, value := range krCfg.Env {
+		merged.Env[key] = value
+	}
+	if _, err := toml.DecodeFile(cfgPath, &merged); err != nil {
+		return err
+	}
+	merged.selectBookDir(0)
+	// Paths to files and devices differ between Kobos, and a wrong one could
+	// point us at the wrong database or input device
+	merged.RcloneCfg = krCfg.RcloneCfg
+	merged.KepubifyBin = krCfg.KepubifyBin
+	merged.RemoteConfig = krCfg.RemoteConfig
+	merged.KoboDBPath = krCfg.KoboDBPath
+	merged.FilterFile = krCfg.FilterFile
+	merged.BatteryPath = krCfg.BatteryPath
+	merged.RcloneCacheDir = krCfg.RcloneCacheDir
+	merged.TouchEventDevice = krCfg.TouchEventDevice
+	merged.ButtonEventFile = krCfg.ButtonEventFile
+	merged.MetadataFile = krCfg.MetadataFile
+	if err := validateConfig(&merged); err != nil {
+		return err
+	}
+	*krCfg = merged
+	return nil
+}
+
+// pushAnnotations uploads the annotation sidecar files in the book directory to
+// the remote. Nothing else is uploaded.
+func pushAnnotations(p Printer, rcBin, rcConf, ksDir string, krCfg *KRcloneConfig) error {
+	stopWifi, err := startWifi(p, krCfg)
+	if err != nil {
+		return err
+	}
+	defer stopWifi()
+	printLevel(p, levelNormal, "Uploading annotations... Please wait.")
+	copyCmd := exec.Command(rcBin, "copy", ksDir, remotePath(krCfg, ""), "--include", "*"+annotationSuffix, "--config", rcConf, "--ask-password=false")
+	copyCmd.Env = rcloneEnv(krCfg)
+	if out, err := copyCmd.CombinedOutput(); err != nil {
+		log.Printf("annotation upload failed: %s: %s", err, redact(string(out), secrets(krCfg)))
+		return err
+	}
+	return nil
+}
+
+// pressConnectButton presses the connect button on Nickel's USB connect screen,
+// trying up to attempts times. Some firmware needs a nudge before the button
+// appears, so after the configured number of failures the screen is refreshed,
+// or the USB cable is unplugged and plugged in again. onFail is called after
+// each failed attempt.
+func pressConnectButton(d Display, attempts int, krCfg *KRcloneConfig, onFail func(i int)) error {
+	var err error
+	confirm := krCfg.ConfirmConnectScreen
+	var tapEvents []byte
+	if krCfg.ButtonEventFile != "" && !simulateDevice {
+		// Read it now, as the internal memory goes away once the button is pressed
+		if tapEvents, err = ioutil.ReadFile(krCfg.ButtonEventFile); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < attempts; i++ {
+		if simulateDevice {
+			d.Println("Simulated: pressing connect button")
+			return nil
+		}
+		err = nil
+		if confirm {
+			// Look for the button without pressing it, so a press can't
+			// dismiss some other dialog
+			if err = d.ButtonScan(false); err != nil && !errors.Is(err, ErrButtonNotFound) {
+				log.Printf("can't check for the connect screen (%s), pressing blindly", err)
+				confirm = false
+				err = nil
+			}
+		}
+		if err == nil && tapEvents != nil {
+			// A replayed tap can't tell whether it hit the button, so check
+			// whether Nickel reacted
+			if err = replayTouch(krCfg.TouchEventDevice, tapEvents); err == nil {
+				if _, err = waitForUnmount(d, 3); err == nil {
+					return nil
+				}
+			}
+		} else if err == nil {
+			if err = d.ButtonScan(true); err == nil {
+				return nil
+			}
+		}
+		if onFail != nil {
+			onFail(i)
+		}
+		failures := i + 1
+		if krCfg.ButtonReplugAfter > 0 && failures%krCfg.ButtonReplugAfter == 0 {
+			log.Printf("connect button not found after %d scans, replugging USB", failures)
+			nickelUSBunplug()
+			time.Sleep(time.Second)
+			nickelUSBplug()
+		} else if krCfg.ButtonRefreshAfter > 0 && failures%krCfg.ButtonRefreshAfter == 0 {
+			log.Printf("connect button not found after %d scans, refreshing screen", failures)
+			d.Refresh()
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return err
+}
+
+// captureTouch records the raw input events of the next tap on the touch
+// screen, for replayTouch to press the connect button with
+func captureTouch(touchEventDevice string, approxTimeout int) ([]byte, error) {
+	touchDev, err := os.Open(touchEventDevice)
+	if err != nil {
+		return nil, err
+	}
+	defer touchDev.Close()
+	events := make(chan []byte)
+	go func() {
+		defer close(events)
+		for {
+			buf := make([]byte, 1024)
+			n, err := touchDev.Read(buf)
+			if err != nil {
+				return
+			}
+			events <- buf[:n]
+		}
+	}()
+	var captured []byte
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			return nil, errors.New("could not read touch device")
+		}
+		captured = append(captured, ev...)
+	case <-time.After(time.Duration(approxTimeout) * time.Second):
+		return nil, errors.New("no tap detected")
+	}
+	// The tap is over once the events stop
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return captured, nil
+			}
+			captured = append(captured, ev...)
+		case <-time.After(500 * time.Millisecond):
+			return captured, nil
+		}
+	}
+}
+
+// replayTouch writes input events recorded by captureTouch back to the touch
+// screen device, which the kernel passes on to Nickel as a real tap
+func replayTouch(touchEventDevice string, events []byte) error {
+	touchDev, err := os.OpenFile(touchEventDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer touchDev.Close()
+	_, err = touchDev.Write(events)
+	return err
+}
+
+// defaultButtonEventFile is where --capture-button saves the tap, and where
+// it is looked for, if button_event_file isn't set
+const defaultButtonEventFile = "button-event.bin"
+
+// captureButton records a tap on Nickel's connect button into the button event
+// file, for models where FBInk can't press it
+func captureButton(d Display, krCfg *KRcloneConfig, eventFile string) error {
+	nickelUSBplug()
+	d.Println("Tap the Connect button on the screen...")
+	events, err := captureTouch(krCfg.TouchEventDevice, 60)
+	if err != nil {
+		nickelUSBunplug()
+		return err
+	}
+	log.Printf("captured %d bytes of touch events", len(events))
+	// Our tap connected the USB, so undo it before saving to the internal memory
+	if _, err := waitForUnmount(d, 10); err != nil {
+		log.Printf("tap did not connect, it may have missed the button")
+	}
+	nickelUSBunplug()
+	if _, err := waitForMount(d, krCfg.RemountTimeoutSec); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(eventFile, events, 0644); err != nil {
+		return err
+	}
+	d.Println("Saved tap to " + filepath.Base(eventFile))
+	return nil
+}
+
+// sameFilesystem checks whether two paths are on the same mounted filesystem
+func sameFilesystem(path1, path2 string) bool {
+	var st1, st2 syscall.Stat_t
+	if syscall.Stat(path1, &st1) != nil || syscall.Stat(path2, &st2) != nil {
+		return false
+	}
+	return st1.Dev == st2.Dev
+}
+
+// nickelUSBplug simulates pugging in a USB cable
+func nickelUSBplug() {
+	if simulateDevice {
+		log.Printf("simulated: usb plug add")
+		return
+	}
+	nickelHWstatusPipe := "/tmp/nickel-hardware-status"
+	nickelPipe, _ := os.OpenFile(nickelHWstatusPipe, os.O_RDWR, os.ModeNamedPipe)
+	nickelPipe.WriteString("usb plug add")
+	nickelPipe.Close()
+	atomic.StoreInt32(&usbPlugged, 1)
+}
+
+// nickelUSBunplug simulates unplugging a USB cable
+func nickelUSBunplug() {
+	if simulateDevice {
+		log.Printf("simulated: usb plug remove")
+		return
+	}
+	nickelHWstatusPipe := "/tmp/nickel-hardware-status"
+	nickelPipe, _ := os.OpenFile(nickelHWstatusPipe, os.O_RDWR, os.ModeNamedPipe)
+	nickelPipe.WriteString("usb plug remove")
+	nickelPipe.Close()
+	atomic.StoreInt32(&usbPlugged, 0)
+}
+
+func internalMemUnmounted(p Printer) bool {
+	mnts, err := linuxproc.ReadMounts("/proc/mounts")
+	chkErrFatal(p, err, "Mount status unavailable! Aborting.", 5)
+	for _, m := range mnts.Mounts {
+		if strings.Contains(m.Device, "mmcblk0p3") {
+			// Internal memory is mounted.
+			return false
+		}
+	}
+	return true
+}
+
+// tmpMntMounted checks whether our temporary mountpoint is in use
+func tmpMntMounted() (bool, error) {
+	mnts, err := linuxproc.ReadMounts("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mnts.Mounts {
+		if filepath.Clean(m.MountPoint) == filepath.Clean(tmpOnboardMnt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// restoreDevice undoes whatever a run had done to the device when it was
+// interrupted, so Nickel isn't left stuck on the connect screen. It is safe to
+// call at any point in a run, and more than once.
+func restoreDevice(p Printer) {
+	os.Chdir("/")
+	// This runs while handling fatal errors, so it mustn't cause another. If
+	// the mounts can't be read, try unmounting anyway.
+	mounted, err := tmpMntMounted()
+	logErrPrint(err)
+	if mounted || err != nil {
+		logErrPrint(unmountTmp())
+	}
+	if atomic.LoadInt32(&usbPlugged) == 1 {
+		nickelUSBunplug()
+	}
+}
+
+// handleSignals restores the device and exits if we are told to stop
+func handleSignals(p Printer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %s, restoring device state", sig)
+		restoreDevice(p)
+		os.Exit(1)
+	}()
+}
+
+// cleanup restores the device to a normal state after a crashed run. It is
+// safe to run when nothing is wrong.
+func cleanup(p Printer, krcloneDir string) {
+	os.Chdir("/")
+	mounted, err := tmpMntMounted()
+	chkErrFatal(p, err, "Mount status unavailable! Aborting.", 5)
+	if mounted {
+		p.Println("Unmounting " + tmpOnboardMnt)
+		logErrPrint(unmountTmp())
+	}
+	// Rescue Nickel if it is stuck on the connect screen
+	nickelUSBunplug()
+	if _, err := waitForMount(p, 30); err != nil {
+		p.Println("Internal memory did not mount!")
+		logErrPrint(err)
+		return
+	}
+	// Retry an interrupted metadata update, but not an interrupted sync
+	switch currentRunState(krcloneDir) {
+	case stateSyncing:
+		setRunState(krcloneDir, stateIdle)
+	case stateUpdatingMetadata:
+		setRunState(krcloneDir, stateAwaitingMetadata)
+	}
+	p.Println("Cleanup complete.")
+}
+
+// fsckInternalMemory checks and repairs the internal memory's filesystem, to
+// clear the dirty bit an unclean shutdown leaves, which can cause the kernel to
+// mount it read only. It must not be mounted anywhere.
+func fsckInternalMemory(p Printer) error {
+	if !internalMemUnmounted(p) {
+		return errors.New("internal memory is mounted, not running fsck")
+	}
+	fsckBin, err := exec.LookPath("fsck.vfat")
+	if err != nil {
+		if fsckBin, err = exec.LookPath("dosfsck"); err != nil {
+			return errors.New("fsck.vfat not found")
+		}
+	}
+	out, err := exec.Command(fsckBin, "-a", internalMemoryDev).CombinedOutput()
+	log.Printf("%s: %s", filepath.Base(fsckBin), out)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// Exit status 1 means errors were found and fixed
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 1 {
+			return nil
+		}
+	}
+	return err
+}
+
+// tmpMntReadOnly checks whether the internal memory came up read only at
+// tmpOnboardMnt, which the kernel does if the filesystem is dirty
+func tmpMntReadOnly(p Printer) bool {
+	mnts, err := linuxproc.ReadMounts("/proc/mounts")
+	chkErrFatal(p, err, "Mount status unavailable! Aborting.", 5)
+	for _, m := range mnts.Mounts {
+		if filepath.Clean(m.MountPoint) != filepath.Clean(tmpOnboardMnt) {
+			continue
+		}
+		for _, opt := range strings.Split(m.Options, ",") {
+			if opt == "ro" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mountTmp mounts the internal memory at tmpOnboardMnt. When simulating, a copy
+// of the internal memory (or just the database) is expected there already.
+func mountTmp(flags uintptr) error {
+	if simulateDevice {
+		log.Printf("simulated: mount %s at %s", internalMemoryDev, tmpOnboardMnt)
+		return nil
+	}
+	return syscall.Mount(internalMemoryDev, tmpOnboardMnt, "vfat", flags, "")
+}
+
+// unmountTmp unmounts the internal memory from tmpOnboardMnt. If a stray file
+// handle keeps it busy, it falls back to a lazy unmount, which the kernel
+// completes once the handle is closed. Otherwise Nickel would never get the
+// internal memory back without a reboot.
+func unmountTmp() error {
+	if simulateDevice {
+		log.Printf("simulated: unmount %s", tmpOnboardMnt)
+		return nil
+	}
+	err := syscall.Unmount(tmpOnboardMnt, 0)
+	if err == nil {
+		return nil
+	}
+	log.Printf("unmount of %s failed (%s), retrying with MNT_DETACH", tmpOnboardMnt, err)
+	return syscall.Unmount(tmpOnboardMnt, syscall.MNT_DETACH)
+}
+
+// waitForUnmount waits for the internal memory to be unmounted, returning how
+// long that took
+func waitForUnmount(p Printer, approxTimeout int) (time.Duration, error) {
+	if simulateDevice {
+		p.Println("Simulated: waiting for unmount")
+		time.Sleep(500 * time.Millisecond)
+		return 500 * time.Millisecond, nil
+	}
+	start := time.Now()
+	iterations := (approxTimeout * 1000) / 250
+	for i := 0; i < iterations; i++ {
+		time.Sleep(250 * time.Millisecond)
+		if internalMemUnmounted(p) {
+			elapsed := time.Since(start)
+			log.Printf("internal memory unmounted after %.1fs", elapsed.Seconds())
+			return elapsed, nil
+		}
+	}
+	return time.Since(start), errors.New("internal memory did not unmount")
+}
+
+// waitForMount waits for the internal memory to be mounted, returning how
+// long that took
+func waitForMount(p Printer, approxTimeout int) (time.Duration, error) {
+	if simulateDevice {
+		p.Println("Simulated: waiting for mount")
+		time.Sleep(500 * time.Millisecond)
+		return 500 * time.Millisecond, nil
+	}
+	start := time.Now()
+	iterations := (approxTimeout * 1000) / 250
+	for i := 0; i < iterations; i++ {
+		time.Sleep(250 * time.Millisecond)
+		if !internalMemUnmounted(p) {
+			elapsed := time.Since(start)
+			log.Printf("internal memory mounted after %.1fs", elapsed.Seconds())
+			return elapsed, nil
+		}
+	}
+	return time.Since(start), errors.New("internal memory did not mount")
+}
+
+// backupDB copies the Kobo database before we write to it. The previous
+// backup is kept as well, in case the last run already damaged the database.
+func backupDB(koboDBpath string) error {
+	bakPath := koboDBpath + ".krbak"
+	if _, err := os.Stat(bakPath); err == nil {
+		if err = os.Rename(bakPath, bakPath+".1"); err != nil {
+			return err
+		}
+	}
+	src, err := os.Open(koboDBpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(bakPath)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// checkIntegrity runs SQLite's integrity check on the Kobo database, so we
+// don't make existing corruption worse by writing to it
+func checkIntegrity(koboDBpath string) error {
+	db, err := sql.Open("sqlite3", "file:"+koboDBpath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err = rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// firmwareVersion reads the firmware version from the version file Nickel keeps
+// on the internal memory, which looks like "N905B,3.0.35+,4.11.11911,..."
+func firmwareVersion() string {
+	version, err := ioutil.ReadFile(filepath.Join(onboardMnt, ".kobo/version"))
+	if err != nil {
+		logErrPrint(err)
+		return "unknown"
+	}
+	fields := strings.Split(strings.TrimSpace(string(version)), ",")
+	if len(fields) < 3 {
+		return "unknown"
+	}
+	return fields[2]
+}
+
+// tableColumns returns the lower cased names of a table's columns. A table that
+// doesn't exist has no columns.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dfltValue interface{}
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	return columns, rows.Err()
+}
+
+// supportedFields drops any metadata fields whose column doesn't exist in this
+// firmware's content table, as the schema changes between firmware versions
+func supportedFields(db *sql.DB, fieldNames []string, firmware string) ([]string, error) {
+	columns, err := tableColumns(db, "content")
+	if err != nil {
+		return nil, err
+	}
+	var supported []string
+	for _, name := range fieldNames {
+		field, ok := metadataFields[strings.ToLower(name)]
+		if ok && !columns[strings.ToLower(field.column)] {
+			log.Printf("skipping column %s, not supported by firmware %s", field.column, firmware)
+			continue
+		}
+		supported = append(supported, name)
+	}
+	return supported, nil
+}
+
+// loadProgress reads how far through the metadata a previous, interrupted
+// update got, returning the index to resume from. If the metadata has changed
+// since, we start from the beginning.
+func loadProgress(progressPath string, metadata []BookMetadata) int {
+	progressJSON, err := ioutil.ReadFile(progressPath)
+	if err != nil {
+		return 0
+	}
+	var progress metadataProgress
+	if err = json.Unmarshal(progressJSON, &progress); err != nil {
+		logErrPrint(err)
+		return 0
+	}
+	if progress.Index < 0 || progress.Index >= len(metadata) || metadata[progress.Index].Lpath != progress.Lpath {
+		return 0
+	}
+	return progress.Index + 1
+}
+
+// saveProgress records the last book committed to the database
+func saveProgress(progressPath string, progress metadataProgress) error {
+	progressJSON, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(progressPath, progressJSON, 0644)
+}
+
+// applyMetadata writes the metadata for each book to the content table of the
+// Kobo database. It returns how many books it attempted to update, and the
+// lpaths of those that failed. This holds all the SQL logic, and none of the
+// mount/USB handling, so it can be run against any copy of the database.
+//
+// Updates are committed in batches. If progressPath is set, the last
+// committed book is recorded there, so an interrupted update can resume.
+func applyMetadata(p Printer, db *sql.DB, ksDir string, metadata []BookMetadata, fieldNames []string, state *KRcloneState, fullUpdate bool, match matchOptions, progressPath string) (int, []string, error) {
+	// Nothing to do, and the progress percentage can't be worked out
+	if len(metadata) == 0 {
+		return 0, nil, nil
+	}
+	query, fields, err := buildUpdateSQL(fieldNames)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Create a prepared statement we can reuse
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer stmt.Close()
+	fallbackStmt, err := db.Prepare(strings.TrimSuffix(query, contentIDMatch) + titleAuthorMatch)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer fallbackStmt.Close()
+	startIndex := 0
+	if progressPath != "" {
+		if startIndex = loadProgress(progressPath, metadata); startIndex > 0 {
+			printLevel(p, levelNormal, fmt.Sprintf("Resuming metadata from book %d", startIndex+1))
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	// Roll back the open batch on any early return. Once a batch is committed,
+	// this does nothing.
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	txStmt := tx.Stmt(stmt)
+	txFallbackStmt := tx.Stmt(fallbackStmt)
+	// Hashes are only recorded once their batch is committed
+	pendingHashes := make(map[string]string)
+	commit := func() error {
+		txStmt.Close()
+		txFallbackStmt.Close()
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		for path, hash := range pendingHashes {
+			state.MetadataHashes[path] = hash
+		}
+		pendingHashes = make(map[string]string)
+		return nil
+	}
+	attempted := 0
+	fallbackMatched, unmatched, unchanged := 0, 0, 0
+	var failedIDs []string
+	p.Println(fmt.Sprintf("Metadata %d/%d (%d%%)", startIndex, len(metadata), startIndex*100/len(metadata)))
+	lastProgress := time.Now()
+	for i := startIndex; i < len(metadata); i++ {
+		meta := metadata[i]
+		// Throttle progress updates, as screen refreshes slow the loop down
+		if time.Since(lastProgress) >= 250*time.Millisecond {
+			printProgress(p, fmt.Sprintf("Metadata %d/%d (%d%%)", i, len(metadata), i*100/len(metadata)), float64(i)/float64(len(metadata)))
+			lastProgress = time.Now()
+		}
+		// Retrieve the values, and update the relevant records in the DB
+		path := meta.Lpath
+		hash := metadataHash(meta)
+		update := path != "" && (fullUpdate || state.MetadataHashes[path] != hash)
+		if update && onlyChangedMetadata && !bookDiffers(tx, ksDir, fields, meta, match) {
+			// The database already has this metadata, so leave the book alone
+			pendingHashes[path] = hash
+			unchanged++
+			update = false
+		}
+
+		if update {
+			attempted++
+			// Match both the raw and URL-encoded forms of the ContentID
+			contentID := lpathContentID(ksDir, path)
+			var args []interface{}
+			for _, field := range fields {
+				args = append(args, field.value(meta))
+			}
+			n, err := execContentID(txStmt, args, contentID)
+			// The book may have been converted to a kepub after it was synced
+			if kepubPath := kepubLpath(path); err == nil && n == 0 && match.kepubAware && kepubPath != "" {
+				n, err = execContentID(txStmt, args, lpathContentID(ksDir, kepubPath))
+			}
+			// The book may have a different filename on the device
+			if matchArgs := titleAuthorArgs(meta); err == nil && n == 0 && match.fallback && matchArgs != nil {
+				var res sql.Result
+				if res, err = txFallbackStmt.Exec(append(append([]interface{}{}, args...), matchArgs...)...); err == nil {
+					if n, _ = res.RowsAffected(); n > 0 {
+						fallbackMatched++
+					}
+				}
+			}
+			if err == nil && n == 0 {
+				unmatched++
+			}
+			if err != nil {
+				log.Printf("metadata update failed for %s: %s", path, err)
+				failedIDs = append(failedIDs, path)
+			} else if n > 0 {
+				// Only remember books Nickel has imported, so the rest are retried next run
+				pendingHashes[path] = hash
+			}
+		}
+
+		if (i+1-startIndex)%metadataBatchSize == 0 && i+1 < len(metadata) {
+			if err = commit(); err != nil {
+				return attempted, failedIDs, err
+			}
+			// Only committed books can be skipped when resuming
+			if progressPath != "" {
+				logErrPrint(saveProgress(progressPath, metadataProgress{Index: i, Lpath: path}))
+			}
+			if tx, err = db.Begin(); err != nil {
+				return attempted, failedIDs, err
+			}
+			txStmt = tx.Stmt(stmt)
+			txFallbackStmt = tx.Stmt(fallbackStmt)
+		}
+	}
+	if err = commit(); err != nil {
+		return attempted, failedIDs, err
+	}
+	if match.fallback {
+		log.Printf("%d books matched by title and author, %d not matched", fallbackMatched, unmatched)
+	}
+	if onlyChangedMetadata {
+		log.Printf("%d books already up to date in the database", unchanged)
+	}
+	// All done, so there's nothing to resume next time
+	if progressPath != "" {
+		if err = os.Remove(progressPath); err != nil && !os.IsNotExist(err) {
+			logErrPrint(err)
+		}
+	}
+	printProgress(p, fmt.Sprintf("Metadata %d/%d (100%%)", len(metadata), len(metadata)), 1)
+	return attempted, failedIDs, nil
+}
+
+// execContentID runs the metadata update for a single ContentID, returning the
+// number of rows updated
+func execContentID(stmt *sql.Stmt, fieldArgs []interface{}, contentID string) (int64, error) {
+	args := append(append([]interface{}{}, fieldArgs...), contentID, encodeLpath(contentID))
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// previewMetadata opens the Kobo database read only, and compares it with the
+// metadata. The changes to the first few books are shown, and all of them
+// logged.
+func previewMetadata(d Display, koboDBpath, ksDir, firmware string, metadata []BookMetadata, fieldNames []string, state *KRcloneState, fullUpdate bool, match matchOptions) (int, error) {
+	db, err := sql.Open("sqlite3", "file:"+koboDBpath+"?mode=ro")
+	if err != nil {
+		d.Println(err.Error())
+		return 0, err
+	}
+	defer db.Close()
+	fieldNames, err = supportedFields(db, fieldNames, firmware)
+	if err != nil {
+		d.Println(err.Error())
+		return 0, err
+	}
+	_, fields, err := buildUpdateSQL(fieldNames)
+	if err != nil {
+		d.Println(err.Error())
+		return 0, err
+	}
+	wouldUpdate, upToDate := 0, 0
+	for _, meta := range metadata {
+		path := meta.Lpath
+		if path == "" || (!fullUpdate && state.MetadataHashes[path] == metadataHash(meta)) {
+			continue
+		}
+		diffs, found, err := metadataDiffs(db, fields, meta, bookMatches(ksDir, meta, match))
+		if err != nil {
+			d.Println(err.Error())
+			return 0, err
+		}
+		if !found {
+			continue
+		}
+		if len(diffs) == 0 {
+			upToDate++
+			continue
+		}
+		wouldUpdate++
+		for _, diff := range diffs {
+			log.Printf("dry run: %s: %s %q -> %q", path, diff.column, diff.old, diff.new)
+			if wouldUpdate <= previewDiffBooks {
+				d.Println(fmt.Sprintf("%s: %s \"%s\" -> \"%s\"", filepath.Base(path), diff.column, shortValue(diff.old), shortValue(diff.new)))
+			}
+		}
+	}
+	if wouldUpdate > previewDiffBooks {
+		d.Println(fmt.Sprintf("...and %d more books. See the log for details.", wouldUpdate-previewDiffBooks))
+	}
+	d.Println(fmt.Sprintf("Dry run: would change %d of %d books (%d already up to date)", wouldUpdate, len(metadata), upToDate))
+	return wouldUpdate, nil
+}
+
+// writeMetadata opens the Kobo database, and writes the metadata for each book
+func writeMetadata(d Display, koboDBpath, ksDir, firmware, progressPath string, metadata []BookMetadata, fieldNames []string, state *KRcloneState, fullUpdate bool, match matchOptions) (int, error) {
+	// Attempt to open the DB
+	stopTimer := timePhase("db open")
+	koboDSN := "file:" + koboDBpath + "?cache=shared&mode=rw"
+	db, err := sql.Open("sqlite3", koboDSN)
+	if err != nil {
+		d.Println(err.Error())
+		return 0, err
+	}
+	defer db.Close()
+	// sql.Open is lazy, so this is the first real access to the DB
+	fieldNames, err = supportedFields(db, fieldNames, firmware)
+	if err != nil {
+		d.Println(err.Error())
+		return 0, err
+	}
+	stopTimer()
+	stopTimer = timePhase("update loop")
+	attempted, failedIDs, err := applyMetadata(d, db, ksDir, metadata, fieldNames, state, fullUpdate, match, progressPath)
+	stopTimer()
+	if err != nil {
+		d.Println(err.Error())
+		return 0, err
+	}
+	// Summarise the run, so errors are visible on the device, not just in the log
+	if fullUpdate {
+		d.Println(fmt.Sprintf("Updated %d/%d books, %d errors", attempted-len(failedIDs), attempted, len(failedIDs)))
+	} else {
+		d.Println(fmt.Sprintf("Updated %d of %d (changed only), %d errors", attempted-len(failedIDs), len(metadata), len(failedIDs)))
+	}
+	if len(failedIDs) > 0 {
+		log.Printf("metadata update failed for: %s", strings.Join(failedIDs, ", "))
+		return attempted - len(failedIDs), fmt.Errorf("%d books failed to update", len(failedIDs))
+	}
+	return attempted, nil
+}
+
+// ReadingSettings is a struct to store the reading settings for a book, from
+// a settings sidecar file. Missing settings are left alone.
+type ReadingSettings struct {
+	FontFamily  *string  `json:"font_family"`
+	FontSize    *float64 `json:"font_size"`
+	LineHeight  *float64 `json:"line_height"`
+	Alignment   *string  `json:"alignment"`
+	LeftMargin  *int     `json:"left_margin"`
+	RightMargin *int     `json:"right_margin"`
+}
+
+// columns maps each setting to its column in the content_settings table
+func (rs ReadingSettings) columns() map[string]interface{} {
+	return map[string]interface{}{
+		"ReadingFontFamily":  rs.FontFamily,
+		"ReadingFontSize":    rs.FontSize,
+		"ReadingLineHeight":  rs.LineHeight,
+		"ReadingAlignment":   rs.Alignment,
+		"ReadingLeftMargin":  rs.LeftMargin,
+		"ReadingRightMargin": rs.RightMargin,
+	}
+}
+
+// applyReadingSettings writes the reading settings from any settings sidecar
+// files in the book directory to the content_settings table, which only
+// exists on some firmware. mntDir is where the book directory is currently
+// mounted.
+func applyReadingSettings(koboDBpath, ksDir, mntDir string) (int, error) {
+	koboDSN := "file:" + koboDBpath + "?cache=shared&mode=rw"
+	db, err := sql.Open("sqlite3", koboDSN)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	columns, err := tableColumns(db, "content_settings")
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		log.Printf("no content_settings table, skipping reading settings")
+		return 0, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	walkErr := filepath.Walk(mntDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, settingsSuffix) {
+			return nil
+		}
+		bookPath := strings.TrimSuffix(path, settingsSuffix)
+		if _, err := os.Stat(bookPath); err != nil {
+			return nil
+		}
+		settingsJSON, err := ioutil.ReadFile(path)
+		if err != nil {
+			logErrPrint(err)
+			return nil
+		}
+		var settings ReadingSettings
+		if err = json.Unmarshal(settingsJSON, &settings); err != nil {
+			log.Printf("skipping %s: %s", path, err)
+			return nil
+		}
+		lpath, _ := filepath.Rel(mntDir, bookPath)
+		contentID := lpathContentID(ksDir, lpath)
+		var setters []string
+		var args []interface{}
+		for column, value := range settings.columns() {
+			if !columns[strings.ToLower(column)] {
+				continue
+			}
+			setters = append(setters, fmt.Sprintf("%s=COALESCE(?, %s)", column, column))
+			args = append(args, value)
+		}
+		if len(setters) == 0 {
+			return nil
+		}
+		// ContentType 6 is a book, rather than a chapter
+		if _, err = tx.Exec("INSERT OR IGNORE INTO content_settings (ContentID, ContentType) VALUES (?, 6)", contentID); err != nil {
+			return err
+		}
+		args = append(args, contentID)
+		if _, err = tx.Exec("UPDATE content_settings SET "+strings.Join(setters, ", ")+" WHERE ContentID = ? AND ContentType = 6", args...); err != nil {
+			return err
+		}
+		applied++
+		return nil
+	})
+	if walkErr != nil {
+		tx.Rollback()
+		return 0, walkErr
+	}
+	return applied, tx.Commit()
+}
+
+// annotationColumns are the columns of the Bookmark table copied to and from
+// annotation sidecar files. VolumeID is the book's ContentID, which is
+// rebuilt from the sidecar's location on import.
+var annotationColumns = []string{
+	"BookmarkID", "ContentID", "StartContainerPath", "StartContainerChildIndex",
+	"StartOffset", "EndContainerPath", "EndContainerChildIndex", "EndOffset",
+	"Text", "Annotation", "DateCreated", "DateModified", "ChapterProgress", "Hidden",
+}
+
+// importAnnotations adds the bookmarks and highlights from any annotation
+// sidecar files in the book directory to the Kobo database. Bookmarks already
+// in the database are left alone. mntDir is where the book directory is
+// currently mounted.
+func importAnnotations(db *sql.DB, ksDir, mntDir string) (int, error) {
+	var sidecars []string
+	filepath.Walk(mntDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, annotationSuffix) {
+			sidecars = append(sidecars, path)
+		}
+		return nil
+	})
+	if len(sidecars) == 0 {
+		return 0, nil
+	}
+	query := "INSERT OR IGNORE INTO Bookmark (VolumeID, " + strings.Join(annotationColumns, ", ") +
+		") VALUES (?" + strings.Repeat(", ?", len(annotationColumns)) + ")"
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+	imported := 0
+	for _, sidecar := range sidecars {
+		bookPath := strings.TrimSuffix(sidecar, annotationSuffix)
+		// Nickel won't show annotations for a book it doesn't have
+		if _, err := os.Stat(bookPath); err != nil {
+			continue
+		}
+		lpath, _ := filepath.Rel(mntDir, bookPath)
+		volumeID := lpathContentID(ksDir, lpath)
+		annotJSON, err := ioutil.ReadFile(sidecar)
+		if err != nil {
+			logErrPrint(err)
+			continue
+		}
+		var annotations []map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(annotJSON))
+		dec.UseNumber()
+		if err = dec.Decode(&annotations); err != nil {
+			log.Printf("skipping %s: %s", sidecar, err)
+			continue
+		}
+		for _, annot := range annotations {
+			// Chapter ContentIDs are stored relative to the book, and an
+			// annotation without one can't be placed
+			chapterID, ok := annot["ContentID"].(string)
+			if !ok {
+				log.Printf("skipping annotation without a ContentID in %s", sidecar)
+				continue
+			}
+			values := []interface{}{volumeID}
+			for _, col := range annotationColumns {
+				val := annot[col]
+				if num, ok := val.(json.Number); ok {
+					if i, err := num.Int64(); err == nil {
+						val = i
+					} else {
+						val, _ = num.Float64()
+					}
+				}
+				if col == "ContentID" {
+					val = volumeID + chapterID
+				}
+				values = append(values, val)
+			}
+			res, err := stmt.Exec(values...)
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				imported++
+			}
+		}
+	}
+	return imported, tx.Commit()
+}
+
+// exportAnnotations writes the bookmarks and highlights for each book in the
+// book directory to an annotation sidecar file next to the book, so they are
+// uploaded to the remote along with it
+func exportAnnotations(db *sql.DB, ksDir, mntDir string) error {
+	prefix := lpathContentID(ksDir, "") + "/"
+	rows, err := db.Query("SELECT VolumeID, "+strings.Join(annotationColumns, ", ")+
+		" FROM Bookmark WHERE substr(VolumeID, 1, ?) = ? ORDER BY VolumeID, DateCreated", len(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	books := make(map[string][]map[string]interface{})
+	for rows.Next() {
+		var volumeID string
+		values := make([]interface{}, len(annotationColumns))
+		dest := []interface{}{&volumeID}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return err
+		}
+		annot := make(map[string]interface{})
+		for i, col := range annotationColumns {
+			val := values[i]
+			if b, ok := val.([]byte); ok {
+				val = string(b)
+			}
+			if col == "ContentID" {
+				val = strings.TrimPrefix(fmt.Sprint(val), volumeID)
+			}
+			annot[col] = val
+		}
+		books[volumeID] = append(books[volumeID], annot)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for volumeID, annotations := range books {
+		bookPath := filepath.Join(mntDir, filepath.FromSlash(strings.TrimPrefix(volumeID, prefix)))
+		if _, err := os.Stat(bookPath); err != nil {
+			continue
+		}
+		annotJSON, err := json.MarshalIndent(annotations, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(bookPath+annotationSuffix, annotJSON, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncAnnotations merges annotations downloaded from the remote into the Kobo
+// database, then writes the merged annotations back out for upload
+func syncAnnotations(d Display, koboDBpath, ksDir, mntDir string) error {
+	koboDSN := "file:" + koboDBpath + "?cache=shared&mode=rw"
+	db, err := sql.Open("sqlite3", koboDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	imported, err := importAnnotations(db, ksDir, mntDir)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
+		d.Println(fmt.Sprintf("Imported %d annotations", imported))
+	}
+	return exportAnnotations(db, ksDir, mntDir)
+}
+
+// withTmpMount gets Nickel to let go of the internal memory by simulating a USB
+// connection, then mounts it at tmpOnboardMnt and calls fn. The internal
+// memory is handed back to Nickel afterwards, whether or not fn succeeds.
+func withTmpMount(d Display, krCfg *KRcloneConfig, readOnly bool, fn func() error) error {
+	stopTimer := timePhase("mount")
+	nickelUSBplug()
+	if err := pressConnectButton(d, 10, krCfg, nil); err != nil {
+		d.Println(err.Error())
+		logErrPrint(err)
+		nickelUSBunplug()
+		return err
+	}
+	// Wait for nickel to unmount the FS
+	spinner := startSpinner(d, "Waiting for Nickel...", krCfg.SpinnerStyle)
+	_, err := waitForUnmount(d, 10)
+	spinner.Stop()
+	chkErrFatal(d, err, "The Filesystem did not unmount. Aborting!", 5)
+	// Nickel may still be tidying up after the unmount, and mounting straight
+	// away sometimes fails on some devices
+	time.Sleep(time.Duration(krCfg.UnmountGraceMs) * time.Millisecond)
+	os.MkdirAll(tmpOnboardMnt, 0666)
+	if krCfg.FsckBeforeMount && !readOnly && !simulateDevice {
+		// Not fatal, the mount may well work anyway
+		printLevel(d, levelNormal, "Checking filesystem...")
+		logErrPrint(fsckInternalMemory(d))
+	}
+	// 'Plugging' in the USB and 'connecting' causes Nickel to unmount /mnt/onboard...
+	// Let's be naughty and remount it elsewhere so we can access the DB without Nickel interfering
+	var mountFlags uintptr
+	if readOnly {
+		mountFlags = syscall.MS_RDONLY
+	}
+	if err = mountTmp(mountFlags); err != nil {
+		d.Println(err.Error())
+		nickelUSBunplug()
+		return err
+	}
+	if !readOnly && !simulateDevice && tmpMntReadOnly(d) {
+		log.Printf("%s mounted read only, remounting read write", tmpOnboardMnt)
+		logErrPrint(syscall.Mount(internalMemoryDev, tmpOnboardMnt, "vfat", syscall.MS_REMOUNT, ""))
+		if tmpMntReadOnly(d) {
+			d.Println("Filesystem mounted read-only, cannot update metadata.")
+			logErrPrint(unmountTmp())
+			waitForUnmount(d, 10)
+			nickelUSBunplug()
+			return errors.New("filesystem mounted read only")
+		}
+	}
+	// Some devices need a moment after mounting before the DB can be read reliably
+	time.Sleep(time.Duration(krCfg.RemountSettleMs) * time.Millisecond)
+	stopTimer()
+	fnErr := fn()
+	// We're done. Better unmount the filesystem before we return control to
+	// Nickel. fn must have closed the DB by now, or the unmount may be lazy.
+	logErrPrint(unmountTmp())
+	// Make sure the FS is unmounted before returning control to Nickel
+	_, err = waitForUnmount(d, 10)
+	chkErrFatal(d, err, "The Filesystem did not unmount. Aborting!", 5)
+	nickelUSBunplug()
+	return fnErr
+}
+
+// rescanNickel gets Nickel to reindex the library, by briefly simulating a USB
+// connection
+func rescanNickel(d Display, krCfg *KRcloneConfig) error {
+	printLevel(d, levelNormal, "Asking Nickel to rescan...")
+	nickelUSBplug()
+	err := func() error {
+		defer nickelUSBunplug()
+		if err := pressConnectButton(d, 10, krCfg, nil); err != nil {
+			return err
+		}
+		if _, err := waitForUnmount(d, 10); err != nil {
+			return err
+		}
+		return nil
+	}()
+	if _, mountErr := waitForMount(d, krCfg.RemountTimeoutSec); mountErr != nil {
+		d.Println("Internal memory did not remount! Please restart your Kobo.")
+		return mountErr
+	}
+	return err
+}
+
+// mountOnlyTimeout is how long, in seconds, mountOnly keeps the internal memory
+// mounted when nobody taps the screen
+const mountOnlyTimeout = 30 * 60
+
+// mountOnly remounts the internal memory at tmpOnboardMnt, and keeps it there
+// until the user taps the screen (or presses Enter, on stdout). Useful for
+// poking at the Kobo database by hand over SSH.
+func mountOnly(d Display, krCfg *KRcloneConfig) error {
+	// Make sure we aren't in the directory we will be attempting to mount/unmount
+	os.Chdir("/")
+	mounted, err := tmpMntMounted()
+	chkErrFatal(d, err, "Mount status unavailable! Aborting.", 5)
+	if mounted {
+		logErrPrint(unmountTmp())
+		log.Printf("recovered stale mount at %s", tmpOnboardMnt)
+	}
+	err = withTmpMount(d, krCfg, false, func() error {
+		d.Println("Mounted at " + tmpOnboardMnt)
+		d.Println("Database: " + filepath.Join(tmpOnboardMnt, krCfg.KoboDBPath))
+		log.Printf("mount only: internal memory mounted at %s", tmpOnboardMnt)
+		if _, onStdout := d.(stdoutDisplay); onStdout {
+			d.Println("Press Enter to unmount.")
+			done := make(chan struct{})
+			go func() {
+				bufio.NewReader(os.Stdin).ReadString('\n')
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(mountOnlyTimeout * time.Second):
+				d.Println("Timed out, unmounting.")
+			}
+		} else {
+			d.Println("Tap the screen to unmount.")
+			if !waitForTap(krCfg.TouchEventDevice, mountOnlyTimeout) {
+				d.Println("Timed out, unmounting.")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := waitForMount(d, krCfg.RemountTimeoutSec); err != nil {
+		d.Println("Internal memory did not remount! Please restart your Kobo.")
+		return err
+	}
+	d.Println("Unmounted, Nickel has the internal memory back.")
+	return nil
+}
+
+// updateMetadata attempts to update the metadata in the Nickel database. Only
+// books whose metadata has changed since the last run are updated, unless
+// the fullMetadata option is set. An interrupted update is resumed, unless the
+// restartMetadata option is set. The book dir's metadata state is kept in
+// stateDir. The run state is left to the caller, as it covers every book dir.
+func updateMetadata(d Display, ksDir, stateDir string, krCfg *KRcloneConfig, opts runOptions) (n int, err error) {
+	if krCfg.ClearBetweenPhases {
+		d.Clear()
+	}
+	// Make sure we aren't in the directory we will be attempting to mount/unmount
+	os.Chdir("/")
+	// A previous run may have crashed with the internal memory still mounted here
+	mounted, err := tmpMntMounted()
+	chkErrFatal(d, err, "Mount status unavailable! Aborting.", 5)
+	if mounted {
+		logErrPrint(unmountTmp())
+		log.Printf("recovered stale mount at %s", tmpOnboardMnt)
+	}
+	// No point going through the USB/remount process with nothing to update
+	if countBookFiles(ksDir) == 0 {
+		d.Println("No books found, skipping metadata")
+		return 0, nil
+	}
+	// Catch a bad metadata_fields option before going through the USB/remount process
+	if _, _, err := buildUpdateSQL(krCfg.MetadataFields); err != nil {
+		d.Println(err.Error())
+		return 0, err
+	}
+	// Open and read the metadata into an array of structs
+	calibreMDpath := resolvePath(ksDir, krCfg.MetadataFile)
+	if _, err := os.Stat(calibreMDpath); os.IsNotExist(err) {
+		log.Printf("metadata file %s not found", calibreMDpath)
+		d.Println("Metadata file " + filepath.Base(calibreMDpath) + " not found. Aborting!")
+		return 0, err
+	}
+	mdFile, err := os.OpenFile(calibreMDpath, os.O_RDONLY, 0666)
+	if err != nil {
+		d.Println("Could not open Metadata File... Aborting!")
+		if mdFile != nil {
+			mdFile.Close()
+		}
+		return 0, err
+	}
+	mdJSON, _ := ioutil.ReadAll(mdFile)
+	mdFile.Close()
+	// Some Calibre plugins export the metadata gzipped
+	if len(mdJSON) >= 2 && mdJSON[0] == 0x1f && mdJSON[1] == 0x8b {
+		gzReader, err := gzip.NewReader(bytes.NewReader(mdJSON))
+		if err == nil {
+			mdJSON, err = ioutil.ReadAll(gzReader)
+			gzReader.Close()
+		}
+		if err != nil {
+			d.Println("Could not decompress Metadata File... Aborting!")
+			return 0, err
+		}
+	}
+	var metadata []BookMetadata
+	json.Unmarshal(mdJSON, &metadata)
+	if patterns := loadIgnorePatterns(ksDir); len(patterns) > 0 {
+		var kept []BookMetadata
+		for _, meta := range metadata {
+			if !ignoredBook(meta.Lpath, patterns) {
+				kept = append(kept, meta)
+			}
+		}
+		log.Printf("ignoring metadata for %d books listed in %s", len(metadata)-len(kept), krIgnoreFile)
+		metadata = kept
+	}
+	state := loadState(stateDir)
+	changed, removed := diffState(state, metadata)
+	log.Printf("metadata: %d books, %d changed, %d removed since last run", len(metadata), len(changed), len(removed))
+	if opts.restartMetadata {
+		if err := os.Remove(filepath.Join(stateDir, progressFile)); err != nil && !os.IsNotExist(err) {
+			logErrPrint(err)
+		}
+	}
+	// The version file can't be read once Nickel unmounts the internal memory
+	firmware := firmwareVersion()
+	log.Printf("firmware version %s", firmware)
+	// Process metadata if it exists
+	if len(metadata) > 0 {
+		d.Println("Updating Metadata...")
+		match := matchOptions{kepubAware: krCfg.KepubAware, fallback: krCfg.FallbackMatch}
+		var updated int
+		if remoteMounted(d, ksDir) {
+			// The metadata has been read from rclone's cache by now
+			d.Println("Unmounting remote. Sync again to remount it.")
+			if err := unmountRemote(ksDir); err != nil {
+				logErrPrint(err)
+				d.Println("Could not unmount remote. Aborting!")
+				return 0, err
+			}
+		}
+		// Don't risk the filesystem when we won't be writing to it
+		updateErr := withTmpMount(d, krCfg, opts.dryRun, func() error {
+			koboDBpath := filepath.Join(tmpOnboardMnt, krCfg.KoboDBPath)
+			if krCfg.CheckDBIntegrity {
+				if err := checkIntegrity(koboDBpath); err != nil {
+					logErrPrint(err)
+					d.Println("Kobo database is damaged. Not writing metadata!")
+					d.Println("Let Nickel repair it (eg: by restarting), then try again.")
+					return err
+				}
+			}
+			if opts.dryRun {
+				var err error
+				updated, err = previewMetadata(d, koboDBpath, ksDir, firmware, metadata, krCfg.MetadataFields, &state, opts.fullMetadata, match)
+				return err
+			}
+			if krCfg.BackupDB {
+				if err := backupDB(koboDBpath); err != nil {
+					logErrPrint(err)
+					d.Println("Could not back up the database. Aborting!")
+					return err
+				}
+			}
+			// stateDir is on the internal memory, which is now mounted here
+			progressPath := filepath.Join(tmpOnboardMnt, strings.TrimPrefix(stateDir, onboardMnt), progressFile)
+			var err error
+			updated, err = writeMetadata(d, koboDBpath, ksDir, firmware, progressPath, metadata, krCfg.MetadataFields, &state, opts.fullMetadata, match)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(ksDir, onboardMnt) {
+				// Only the internal memory is remounted, so the sidecar files can't be read
+				if krCfg.ReadingSettings || krCfg.SyncAnnotations {
+					log.Printf("book dir %s is not on the internal memory, skipping reading settings and annotations", ksDir)
+				}
+				return nil
+			}
+			// The book dir is on the internal memory too
+			mntDir := filepath.Join(tmpOnboardMnt, strings.TrimPrefix(ksDir, onboardMnt))
+			// Not fatal, the metadata has already been written
+			if krCfg.ReadingSettings {
+				if applied, err := applyReadingSettings(koboDBpath, ksDir, mntDir); err != nil {
+					logErrPrint(err)
+					d.Println("Could not apply reading settings.")
+				} else if applied > 0 {
+					d.Println(fmt.Sprintf("Applied reading settings to %d books", applied))
+				}
+			}
+			if krCfg.SyncAnnotations {
+				if err := syncAnnotations(d, koboDBpath, ksDir, mntDir); err != nil {
+					logErrPrint(err)
+					d.Println("Could not sync annotations.")
+				}
+			}
+			return nil
+		})
+		if updateErr == nil && !opts.dryRun {
+			d.Println("Metadata updated!")
+			markSeen(&state, metadata, time.Now())
+			forgetBooks(&state, removed)
+		}
+		// The state file lives on the internal memory, so wait for Nickel to remount it
+		if _, err = waitForMount(d, krCfg.RemountTimeoutSec); err == nil {
+			logErrPrint(saveState(stateDir, state))
+		} else {
+			logErrPrint(err)
+		}
+		if updateErr == nil && !opts.dryRun && updated > 0 && krCfg.RescanAfterMetadata {
+			// Not fatal, the metadata is written either way
+			if err := rescanNickel(d, krCfg); err != nil {
+				logErrPrint(err)
+				d.Println("Nickel rescan failed.")
+			}
+		}
+		return updated, updateErr
+	}
+	d.Println("No metadata to update!")
+	return 0, nil
+}
+
+// buildSyncArgs builds the argument list for the rclone sync command. rclone
+// applies filter rules in the order given, so any excludes must come before
+// include rules.
+func buildSyncArgs(rcRemote, ksDir, krcloneDir, rcConf string, krCfg *KRcloneConfig) []string {
+	// Never let rclone block waiting for a password on stdin
+	rcArgs := []string{krCfg.SyncMode, rcRemote, ksDir, "--config", rcConf, "--ask-password=false"}
+	if krCfg.IgnoreExisting {
+		// Only new books are wanted, so never delete anything either
+		rcArgs[0] = "copy"
+		rcArgs = append(rcArgs, "--ignore-existing")
+	}
+	if krCfg.MaxAge != "" {
+		rcArgs = append(rcArgs, "--max-age", krCfg.MaxAge)
+	}
+	if krCfg.FastList {
+		rcArgs = append(rcArgs, "--fast-list")
+	}
+	switch krCfg.CompareMethod {
+	case "checksum":
+		rcArgs = append(rcArgs, "--checksum")
+	case "size-only":
+		rcArgs = append(rcArgs, "--size-only")
+	}
+	// Only override rclone's defaults when set
+	if krCfg.Transfers > 0 {
+		rcArgs = append(rcArgs, "--transfers", strconv.Itoa(krCfg.Transfers))
+	} else if krCfg.Transfers < 0 {
+		log.Printf("ignoring invalid transfers value %d", krCfg.Transfers)
+	}
+	if krCfg.Checkers > 0 {
+		rcArgs = append(rcArgs, "--checkers", strconv.Itoa(krCfg.Checkers))
+	} else if krCfg.Checkers < 0 {
+		log.Printf("ignoring invalid checkers value %d", krCfg.Checkers)
+	}
+	for _, pattern := range krCfg.ExcludePaths {
+		if strings.TrimSpace(pattern) == "" || strings.ContainsAny(pattern, "\r\n") {
+			log.Printf("ignoring invalid exclude pattern %q", pattern)
+			continue
+		}
+		rcArgs = append(rcArgs, "--exclude", pattern)
+	}
+	if _, err := os.Stat(filepath.Join(ksDir, krIgnoreFile)); err == nil {
+		// The ignore file only exists on the device, so don't let rclone delete it either
+		rcArgs = append(rcArgs, "--exclude", "/"+krIgnoreFile, "--exclude-from", filepath.Join(ksDir, krIgnoreFile))
+	}
+	if extractedPath := filepath.Join(krcloneDir, extractedFile); krCfg.ExtractArchives {
+		// Otherwise extracted archives are downloaded again, and their books deleted
+		if _, err := os.Stat(extractedPath); err == nil {
+			rcArgs = append(rcArgs, "--exclude-from", extractedPath)
+		}
+	}
+	if krCfg.KepubifyBin != "" {
+		// Don't let rclone delete the kepubs we create, as they won't exist on the remote
+		rcArgs = append(rcArgs, "--exclude", "*.kepub.epub")
+		// Nor download the epubs they replaced again
+		if convertedPath := filepath.Join(krcloneDir, convertedFile); !krCfg.KepubKeepOriginal {
+			if _, err := os.Stat(convertedPath); err == nil {
+				rcArgs = append(rcArgs, "--exclude-from", convertedPath)
+			}
+		}
+	}
+	if krCfg.FilterFile != "" {
+		rcArgs = append(rcArgs, "--filter-from", krCfg.FilterFile)
+	}
+	return rcArgs
+}
+
+// runPolling starts cmd, and calls poll every interval until it exits, so
+// we can keep the screen up to date while it runs. Errors are the same as
+// cmd.Run would return.
+func runPolling(cmd *exec.Cmd, interval time.Duration, poll func()) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			poll()
+		}
+	}
+}
+
+// rcloneEnv returns the environment rclone should be run with
+func rcloneEnv(krCfg *KRcloneConfig) []string {
+	env := os.Environ()
+	if krCfg.RcloneConfigPass != "" {
+		env = append(env, "RCLONE_CONFIG_PASS="+krCfg.RcloneConfigPass)
+	}
+	// Credentials from the [env] section, so they needn't be in the rclone config
+	for key, value := range krCfg.Env {
+		if !strings.HasPrefix(key, "RCLONE_") {
+			log.Printf("ignoring env %s, only RCLONE_ variables may be set", key)
+			continue
+		}
+		env = append(env, key+"="+value)
+	}
+	// Keep rclone's cache and temporary files off the small root partition
+	if krCfg.RcloneCacheDir != "" {
+		env = append(env, "RCLONE_CACHE_DIR="+krCfg.RcloneCacheDir, "TMPDIR="+krCfg.RcloneCacheDir)
+	}
+	return env
+}
+
+// currentTransfer finds the file rclone most recently reported transferring,
+// from the end of its log. It needs the INFO log level.
+func currentTransfer(rcLog string) string {
+	f, err := os.Open(rcLog)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > 4096 {
+		f.Seek(-4096, io.SeekEnd)
+	}
+	tail, _ := ioutil.ReadAll(f)
+	name, last := "", -1
+	for _, re := range []*regexp.Regexp{transferringRegex, copiedRegex} {
+		matches := re.FindAllSubmatchIndex(tail, -1)
+		if len(matches) > 0 {
+			if m := matches[len(matches)-1]; m[0] > last {
+				name, last = string(tail[m[2]:m[3]]), m[0]
+			}
+		}
+	}
+	return name
+}
+
+// Where rclone's remote control API listens when use_rcd is set
+const rcdAddr = "127.0.0.1:5572"
+
+var rcdClient = &http.Client{Timeout: 30 * time.Second}
+
+// rcdAuth is the user and password an rcd run was started with
+type rcdAuth struct {
+	user, pass string
+}
+
+// newRcdAuth makes a random user and password, so that nothing else on the
+// device can drive the API while a sync runs
+func newRcdAuth() (rcdAuth, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return rcdAuth{}, err
+	}
+	return rcdAuth{hex.EncodeToString(buf[:16]), hex.EncodeToString(buf[16:])}, nil
+}
+
+// rcdCall calls a method of rclone's remote control API, decoding the reply
+// into result if it isn't nil
+func rcdCall(auth rcdAuth, method string, params map[string]interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+rcdAddr+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(auth.user, auth.pass)
+	resp, err := rcdClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var rcErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&rcErr)
+		return fmt.Errorf("rclone rc %s failed: %s", method, rcErr.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// runRcdSync runs the sync built by buildSyncArgs as a job in "rclone rcd",
+// showing its progress on the spinner. Flags given to rcd apply to the jobs it
+// runs, so those are passed as they are. EXPERIMENTAL.
+func runRcdSync(spinner *activitySpinner, rcBin string, rcArgs []string, stderr io.Writer, krCfg *KRcloneConfig) error {
+	auth, err := newRcdAuth()
+	if err != nil {
+		return err
+	}
+	rcdArgs := append([]string{"rcd", "--rc-addr", rcdAddr, "--rc-user", auth.user, "--rc-pass", auth.pass}, rcArgs[3:]...)
+	rcdCmd := exec.Command(rcBin, rcdArgs...)
+	rcdCmd.Env = rcloneEnv(krCfg)
+	rcdCmd.Stderr = stderr
+	if err := rcdCmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		// rclone runs from the internal memory, so it must have quit before
+		// Nickel can unmount it
+		if err := rcdCall(auth, "core/quit", nil, nil); err != nil {
+			logErrPrint(err)
+			rcdCmd.Process.Kill()
+		}
+		rcdCmd.Wait()
+	}()
+	ready := false
+	for i := 0; i < 20 && !ready; i++ {
+		time.Sleep(500 * time.Millisecond)
+		ready = rcdCall(auth, "core/version", nil, nil) == nil
+	}
+	if !ready {
+		return errors.New("rclone rcd did not start")
+	}
+	var job struct {
+		JobID int64 `json:"jobid"`
+	}
+	params := map[string]interface{}{"srcFs": rcArgs[1], "dstFs": rcArgs[2], "_async": true}
+	if err := rcdCall(auth, "sync/"+rcArgs[0], params, &job); err != nil {
+		return err
+	}
+	log.Printf("rclone rcd running %s as job %d", rcArgs[0], job.JobID)
+	for {
+		time.Sleep(time.Second)
+		var status struct {
+			Finished bool   `json:"finished"`
+			Success  bool   `json:"success"`
+			Error    string `json:"error"`
+		}
+		if err := rcdCall(auth, "job/status", map[string]interface{}{"jobid": job.JobID}, &status); err != nil {
+			return err
+		}
+		if status.Finished {
+			if !status.Success {
+				return errors.New(status.Error)
+			}
+			return nil
+		}
+		var stats struct {
+			Bytes        int64 `json:"bytes"`
+			TotalBytes   int64 `json:"totalBytes"`
+			Transferring []struct {
+				Name string `json:"name"`
+			} `json:"transferring"`
+		}
+		if err := rcdCall(auth, "core/stats", nil, &stats); err != nil || len(stats.Transferring) == 0 {
+			continue
+		}
+		msg := "Syncing " + shortValue(filepath.Base(stats.Transferring[0].Name))
+		if stats.TotalBytes > 0 {
+			msg += fmt.Sprintf(" (%d%%)", stats.Bytes*100/stats.TotalBytes)
+		}
+		spinner.SetMessage(msg)
+	}
+}
+
+// isTokenError checks rclone's output for signs that an OAuth token could not
+// be refreshed
+func isTokenError(rcOutput string) bool {
+	rcOutput = strings.ToLower(rcOutput)
+	for _, msg := range []string{"couldn't fetch token", "cannot fetch token", "invalid_grant", "token expired", "failed to refresh token"} {
+		if strings.Contains(rcOutput, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// secrets returns the configured values that must never be logged
+func secrets(krCfg *KRcloneConfig) []string {
+	var values []string
+	if krCfg.RcloneConfigPass != "" {
+		values = append(values, krCfg.RcloneConfigPass)
+	}
+	for _, value := range krCfg.Env {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// redact hides any secrets in str
+func redact(str string, secrets []string) string {
+	for _, secret := range secrets {
+		str = strings.Replace(str, secret, "[redacted]", -1)
+	}
+	return str
+}
+
+// logTail copies the last n lines of a log file into our own log, with any
+// secrets redacted
+func logTail(logPath string, n int, secrets []string) {
+	logData, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		logErrPrint(err)
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(logData)), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for _, line := range lines {
+		log.Printf("%s: %s", filepath.Base(logPath), redact(line, secrets))
+	}
+}
+
+// printInfo shows the effective configuration, and whether the files and
+// directories it refers to exist. It doesn't change anything.
+func printInfo(d Display, rcBin, rcConf string, pairs []bookDirPair, krCfg *KRcloneConfig) {
+	exists := func(path string) string {
+		if _, err := os.Stat(path); err != nil {
+			return "missing"
+		}
+		return "ok"
+	}
+	version, err := detectRcloneVersion(rcBin)
+	if err != nil {
+		version = "unknown"
+	}
+	lines := []string{
+		"rclone: " + rcBin + " (" + exists(rcBin) + ")",
+		"rclone version: " + version,
+		"Config: " + rcConf + " (" + exists(rcConf) + ")",
+		"Remote: " + krCfg.RCremoteName,
+	}
+	for _, pair := range pairs {
+		lines = append(lines, "Remote dir: "+pair.cfg.RCrootDir, "Book dir: "+pair.bookDir+" ("+exists(pair.bookDir)+")")
+	}
+	for key := range krCfg.Env {
+		lines = append(lines, "Env: "+key+"=[redacted]")
+	}
+	_, onStdout := d.(stdoutDisplay)
+	for _, line := range lines {
+		d.Println(line)
+		if !onStdout {
+			fmt.Println(line)
+		}
+	}
+}
+
+// doctor runs non-destructive checks of everything kobo-rclone needs, to help
+// when diagnosing problems. A pass or fail line is printed and logged for each,
+// and the number of failures returned.
+func doctor(d Display, rcBin, rcConf, ksDir string, krCfg *KRcloneConfig) int {
+	failures := 0
+	check := func(name string, err error) {
+		line := "PASS " + name
+		if err != nil {
+			line = "FAIL " + name + ": " + err.Error()
+			failures++
+		}
+		log.Print(line)
+		d.Println(line)
+	}
+	rcloneErr := checkRcloneFiles(rcBin, rcConf)
+	check("rclone files", rcloneErr)
+	if rcloneErr == nil {
+		version, err := detectRcloneVersion(rcBin)
+		if err == nil && !versionAtLeast(version, minRcloneVersion) {
+			err = fmt.Errorf("older than %s", minRcloneVersion)
+		}
+		if version == "" {
+			version = "unknown"
+		}
+		check("rclone runs (version "+version+")", err)
+	}
+	check("config valid", validateConfig(krCfg))
+	if rcloneErr == nil {
+		stopWifi, err := startWifi(d, krCfg)
+		if err == nil {
+			lsCmd := exec.Command(rcBin, "lsf", remotePath(krCfg, ""), "--max-depth", "1", "--config", rcConf,
+				"--ask-password=false", "--contimeout", "15s", "--timeout", "30s")
+			lsCmd.Env = rcloneEnv(krCfg)
+			var out []byte
+			if out, err = lsCmd.CombinedOutput(); err != nil {
+				log.Printf("remote listing failed: %s", redact(string(out), secrets(krCfg)))
+			}
+			stopWifi()
+		}
+		check("remote reachable", err)
+	}
+	_, err := os.Stat(ksDir)
+	check("book dir exists", err)
+	var fsStat syscall.Statfs_t
+	if err = syscall.Statfs(filepath.Dir(ksDir), &fsStat); err == nil {
+		freeMB := fsStat.Bavail * uint64(fsStat.Bsize) / (1024 * 1024)
+		if freeMB < 100 {
+			err = errors.New("less than 100 MB free")
+		}
+		check(fmt.Sprintf("free space (%d MB)", freeMB), err)
+	} else {
+		check("free space", err)
+	}
+	batteryPath := krCfg.BatteryPath
+	if batteryPath == "" {
+		batteryPath = batteryCapacityPath()
+	}
+	if level, err := batteryLevel(batteryPath); err == nil {
+		if level < krCfg.MinBatteryPercent {
+			err = fmt.Errorf("below min_battery_percent (%d%%)", krCfg.MinBatteryPercent)
+		}
+		check(fmt.Sprintf("battery (%d%%)", level), err)
+	} else {
+		check("battery", err)
+	}
+	// The version file can't be read once Nickel unmounts the internal memory
+	firmware := firmwareVersion()
+	if firmware == "unknown" {
+		err = errors.New("could not read .kobo/version")
+	} else {
+		err = nil
+	}
+	check("firmware version ("+firmware+")", err)
+	var books int
+	err = withTmpMount(d, krCfg, true, func() error {
+		db, err := sql.Open("sqlite3", "file:"+filepath.Join(tmpOnboardMnt, krCfg.KoboDBPath)+"?mode=ro")
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.QueryRow("SELECT COUNT(*) FROM content WHERE ContentType = 6").Scan(&books)
+	})
+	check(fmt.Sprintf("Kobo database readable (%d books)", books), err)
+	d.Println(fmt.Sprintf("%d checks failed", failures))
+	return failures
 }
 
-// chkErrFatal prints a message to the Kobo screen, then exits the program
-func chkErrFatal(err error, usrMsg string, msgDuration int) {
+// countCovers counts the books with and without library thumbnails. Nickel
+// sets a book's ImageId when it imports it, whether or not the book has a
+// cover, so the thumbnail files are what count. Books on the SD card keep
+// theirs in the SD card's images directory.
+func countCovers(db *sql.DB, onboardImages, sdImages string) (int, int, error) {
+	rows, err := db.Query("SELECT ContentID, COALESCE(ImageId, '') FROM content WHERE ContentType = 6")
 	if err != nil {
-		if usrMsg != "" {
-			fbPrint(usrMsg)
-			time.Sleep(time.Duration(msgDuration) * time.Second)
+		return 0, 0, err
+	}
+	defer rows.Close()
+	with, without := 0, 0
+	for rows.Next() {
+		var contentID, imageID string
+		if err := rows.Scan(&contentID, &imageID); err != nil {
+			return 0, 0, err
+		}
+		imagesDir := onboardImages
+		if strings.HasPrefix(contentID, "file://"+sdMnt) {
+			imagesDir = sdImages
+		}
+		if imageID == "" {
+			without++
+			continue
+		}
+		coverDir, imageID := coverImageDir(imagesDir, imageID)
+		if _, err := os.Stat(filepath.Join(coverDir, imageID+coverSizes[0].suffix)); err == nil {
+			with++
+		} else {
+			without++
 		}
-		log.Fatal(err)
 	}
+	return with, without, rows.Err()
 }
 
-// logErrPrint is a convenience function for logging errors
-func logErrPrint(err error) {
+// libraryStats reports on the books in the Kobo database, reading it from a
+// read only mount
+func libraryStats(d Display, krCfg *KRcloneConfig) error {
+	var lines []string
+	err := withTmpMount(d, krCfg, true, func() error {
+		db, err := sql.Open("sqlite3", "file:"+filepath.Join(tmpOnboardMnt, krCfg.KoboDBPath)+"?mode=ro")
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		columns, err := tableColumns(db, "content")
+		if err != nil {
+			return err
+		}
+		// ContentType 6 is a book, rather than a chapter
+		stats := []struct {
+			label, column, query string
+		}{
+			{"Books", "ContentType", "SELECT COUNT(*) FROM content WHERE ContentType = 6"},
+			{"Series", "Series", "SELECT COUNT(DISTINCT Series) FROM content WHERE ContentType = 6 AND Series != ''"},
+			{"Size (MB)", "___FileSize", "SELECT COALESCE(SUM(___FileSize), 0) / 1048576 FROM content WHERE ContentType = 6"},
+		}
+		for _, stat := range stats {
+			if !columns[strings.ToLower(stat.column)] {
+				continue
+			}
+			var n int64
+			if err = db.QueryRow(stat.query).Scan(&n); err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%s: %d", stat.label, n))
+		}
+		if columns["imageid"] {
+			with, without, err := countCovers(db, filepath.Join(tmpOnboardMnt, ".kobo-images"), filepath.Join(sdMnt, ".kobo-images"))
+			if err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("With covers: %d", with), fmt.Sprintf("Without covers: %d", without))
+		}
+		return nil
+	})
 	if err != nil {
-		log.Print(err)
+		d.Println("Could not read library stats.")
+		return err
 	}
-}
-
-// fbPrint uses the fbink program to print text on the Kobo screen
-func fbPrint(str string) {
-	if fbMsgBuffer.Len() >= 5 {
-		elt := fbMsgBuffer.Front()
-		fbMsgBuffer.Remove(elt)
+	if krCfg.ClearBetweenPhases {
+		d.Clear()
 	}
-	fbMsgBuffer.PushBack(str)
-	fbinkOpts.Col = 1
-	row := int16(4)
-	for m := fbMsgBuffer.Front(); m != nil; m = m.Next() {
-		fbinkOpts.Row = row
-		rowsPrinted, err := gofbink.Print(gofbink.FBFDauto, m.Value.(string), fbinkOpts)
-		if err == nil {
-			row += int16(rowsPrinted)
-		} else {
-			logErrPrint(err)
-		}
+	for _, line := range lines {
+		d.Println(line)
 	}
+	return nil
 }
 
-// metadataLockfileExists searches for the existance of a lock file
-func metadataLockfileExists(krcloneDir string) bool {
-	exists := true
-	if _, err := os.Stat(filepath.Join(krcloneDir, metaLockFile)); os.IsNotExist(err) {
-		exists = false
+// confirmConfig shows a summary of where books will be synced from and to, and
+// waits for the user to tap the screen to confirm it
+func confirmConfig(d Display, pairs []bookDirPair, krCfg *KRcloneConfig) bool {
+	d.Println("Remote: " + krCfg.RCremoteName)
+	for _, pair := range pairs {
+		d.Println("Remote dir: " + pair.cfg.RCrootDir)
+		d.Println("Book dir: " + pair.bookDir)
 	}
-	return exists
-}
-
-// nickelUSBplug simulates pugging in a USB cable
-func nickelUSBplug() {
-	nickelHWstatusPipe := "/tmp/nickel-hardware-status"
-	nickelPipe, _ := os.OpenFile(nickelHWstatusPipe, os.O_RDWR, os.ModeNamedPipe)
-	nickelPipe.WriteString("usb plug add")
-	nickelPipe.Close()
-}
-
-// nickelUSBunplug simulates unplugging a USB cable
-func nickelUSBunplug() {
-	nickelHWstatusPipe := "/tmp/nickel-hardware-status"
-	nickelPipe, _ := os.OpenFile(nickelHWstatusPipe, os.O_RDWR, os.ModeNamedPipe)
-	nickelPipe.WriteString("usb plug remove")
-	nickelPipe.Close()
+	d.Println("Tap screen within 30s to start syncing.")
+	return waitForTap(krCfg.TouchEventDevice, 30)
 }
 
-func internalMemUnmounted() bool {
+// remoteMounted checks whether rclone has the remote mounted at the book dir
+func remoteMounted(p Printer, ksDir string) bool {
 	mnts, err := linuxproc.ReadMounts("/proc/mounts")
-	chkErrFatal(err, "Mount status unavailable! Aborting.", 5)
+	chkErrFatal(p, err, "Mount status unavailable! Aborting.", 5)
 	for _, m := range mnts.Mounts {
-		if strings.Contains(m.Device, "mmcblk0p3") {
-			// Internal memory is mounted.
-			return false
+		if filepath.Clean(m.MountPoint) == filepath.Clean(ksDir) && strings.HasPrefix(m.FSType, "fuse") {
+			return true
 		}
 	}
-	return true
+	return false
 }
 
-func waitForUnmount(approxTimeout int) error {
-	iterations := (approxTimeout * 1000) / 250
-	for i := 0; i < iterations; i++ {
-		time.Sleep(250 * time.Millisecond)
-		if internalMemUnmounted() {
-			return nil
-		}
+// mountRemote starts "rclone mount" on the book dir, and leaves it running in
+// the background after we exit, so books are only downloaded when opened.
+// Nickel doesn't import books from the mount, so this is mainly useful with
+// readers that open files directly, such as KOReader. EXPERIMENTAL.
+func mountRemote(d Display, rcBin, rcConf, rcRemote, ksDir, krcloneDir string, krCfg *KRcloneConfig) error {
+	if remoteMounted(d, ksDir) {
+		d.Println("Remote is already mounted.")
+		return nil
 	}
-	return errors.New("internal memory did not unmount")
-}
-
-func waitForMount(approxTimeout int) error {
-	iterations := (approxTimeout * 1000) / 250
-	for i := 0; i < iterations; i++ {
-		time.Sleep(250 * time.Millisecond)
-		if !internalMemUnmounted() {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		d.Println("FUSE is not available on this device. Cannot mount.")
+		return err
+	}
+	rcLog := filepath.Join(krcloneDir, rcloneLogFile)
+	os.Remove(rcLog)
+	// Books synced before switching to mount mode are hidden, not deleted
+	rcArgs := []string{"mount", rcRemote, ksDir, "--config", rcConf, "--ask-password=false",
+		"--vfs-cache-mode", "minimal", "--allow-non-empty",
+		"--log-file", rcLog, "--log-level", krCfg.RcloneLogLevel}
+	rcArgs = append(rcArgs, krCfg.ExtraRcloneArgs...)
+	// WiFi is left on, as the mount needs it for as long as it runs
+	if _, err := startWifi(d, krCfg); err != nil {
+		return err
+	}
+	spinner := startSpinner(d, "Mounting remote... Please wait.", krCfg.SpinnerStyle)
+	mountCmd := exec.Command(rcBin, rcArgs...)
+	mountCmd.Env = rcloneEnv(krCfg)
+	// Start rclone in its own session, so it outlives us
+	mountCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := mountCmd.Start(); err != nil {
+		// Stop the spinner first, or its last frame replaces the outcome
+		spinner.Stop()
+		d.Println("Could not start rclone. Aborting!")
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- mountCmd.Wait() }()
+	for i := 0; i < 30; i++ {
+		select {
+		case err := <-exited:
+			spinner.Stop()
+			logTail(rcLog, 20, secrets(krCfg))
+			d.Println("rclone mount failed. Aborting!")
+			if err == nil {
+				err = errors.New("rclone mount exited")
+			}
+			return err
+		case <-time.After(time.Second):
+		}
+		if remoteMounted(d, ksDir) {
+			spinner.Stop()
+			log.Printf("remote mounted at %s by rclone pid %d", ksDir, mountCmd.Process.Pid)
+			d.Println("Remote mounted! Books download when opened.")
 			return nil
 		}
 	}
-	return errors.New("internal memory did not mount")
+	spinner.Stop()
+	mountCmd.Process.Kill()
+	d.Println("Remote did not mount. Aborting!")
+	return errors.New("remote did not mount")
 }
 
-// fbButtonScan simulates pressing the touch screen to 'press' the 'connect' button
-// when 'plugging in' the usb cable.
-//
-// It replays events captured by /dev/input/event1, which are stored in a model specific
-// file.
-func fbButtonScan(pressButton bool) error {
-	err := gofbink.ButtonScan(gofbink.FBFDauto, pressButton, false)
-	if err != nil {
-		if strings.Compare(err.Error(), "EXIT_FAILURE") == 0 {
-			return errors.New("button not found")
-		} else if strings.Compare(err.Error(), "ENOTSUP") == 0 {
-			return errors.New("button press failure")
-		} else if strings.Compare(err.Error(), "ENODEV") == 0 {
-			return errors.New("touch event failure")
-		}
+// unmountRemote stops an rclone mount on the book dir. Nickel can't unmount
+// the internal memory while it is there.
+func unmountRemote(ksDir string) error {
+	if err := syscall.Unmount(ksDir, 0); err != nil {
+		log.Printf("unmount of %s failed (%s), retrying with MNT_DETACH", ksDir, err)
+		return syscall.Unmount(ksDir, syscall.MNT_DETACH)
 	}
 	return nil
 }
 
-// updateMetadata attempts to update the metadata in the Nickel database
-func updateMetadata(ksDir, krcloneDir string) {
-	// Make sure we aren't in the directory we will be attempting to mount/unmount
-	os.Chdir("/")
-	os.Remove(filepath.Join(krcloneDir, metaLockFile))
-	// Open and read the metadata into an array of structs
-	calibreMDpath := filepath.Join(ksDir, ".metadata.calibre")
-	mdFile, err := os.OpenFile(calibreMDpath, os.O_RDONLY, 0666)
-	if err != nil {
-		fbPrint("Could not open Metadata File... Aborting!")
-		if mdFile != nil {
-			mdFile.Close()
+// syncBooks runs the rclone program using the preconfigered configuration file.
+// Nickel doesn't see the new books until importBooks runs.
+func syncBooks(d Display, rcBin, rcConf, ksDir, krcloneDir string, krCfg *KRcloneConfig) (int, error) {
+	if krCfg.ClearBetweenPhases {
+		d.Clear()
+	}
+	rcRemote := remotePath(krCfg, "")
+	if krCfg.SyncMode == "mount" {
+		return 0, mountRemote(d, rcBin, rcConf, rcRemote, ksDir, krcloneDir, krCfg)
+	}
+	if krCfg.SyncMode != "sync" && krCfg.SyncMode != "copy" {
+		d.Println("Invalid sync_mode \"" + krCfg.SyncMode + "\". Aborting!")
+		return 0, errors.New("invalid sync_mode")
+	}
+	switch krCfg.CompareMethod {
+	case "default", "checksum", "size-only":
+	default:
+		d.Println("Invalid compare_method \"" + krCfg.CompareMethod + "\". Aborting!")
+		return 0, errors.New("invalid compare_method")
+	}
+	if krCfg.MaxAge != "" {
+		if !maxAgeRegex.MatchString(krCfg.MaxAge) {
+			d.Println("Invalid max_age \"" + krCfg.MaxAge + "\". Aborting!")
+			return 0, errors.New("invalid max_age")
+		}
+		if krCfg.SyncMode == "sync" && !krCfg.IgnoreExisting {
+			d.Println("Warning: max_age with sync mode may delete older books. Consider copy mode.")
 		}
-		return
 	}
-	mdJSON, _ := ioutil.ReadAll(mdFile)
-	mdFile.Close()
-	var metadata []BookMetadata
-	json.Unmarshal(mdJSON, &metadata)
-	// Process metadata if it exists
-	if len(metadata) > 0 {
-		fbPrint("Updating Metadata...")
-		nickelUSBplug()
-		for i := 0; i < 10; i++ {
-			err = fbButtonScan(true)
-			if i == 9 && err != nil {
-				fbPrint(err.Error())
-				logErrPrint(err)
-				return
-			}
-			if err == nil {
-				break
+	rcArgs := buildSyncArgs(rcRemote, ksDir, krcloneDir, rcConf, krCfg)
+	// Start each run with a fresh rclone log, so it doesn't grow forever
+	rcLog := filepath.Join(krcloneDir, rcloneLogFile)
+	os.Remove(rcLog)
+	// Regular stats in the log show which files are transferring
+	rcArgs = append(rcArgs, "--log-file", rcLog, "--log-level", krCfg.RcloneLogLevel, "--stats", "5s")
+	// Passed through verbatim, after our own flags, so they can override them
+	rcArgs = append(rcArgs, krCfg.ExtraRcloneArgs...)
+	batteryPath := krCfg.BatteryPath
+	if batteryPath == "" {
+		batteryPath = batteryCapacityPath()
+	}
+	if level, err := batteryLevel(batteryPath); err == nil {
+		log.Printf("battery at %d%% before sync", level)
+		if level < krCfg.MinBatteryPercent {
+			d.Println(fmt.Sprintf("Battery low (%d%%)! Tap screen to sync anyway.", level))
+			if !waitForTap(krCfg.TouchEventDevice, 30) {
+				d.Println("Sync cancelled.")
+				return 0, errors.New("sync cancelled on low battery")
 			}
-			time.Sleep(500 * time.Millisecond)
 		}
-		// Wait for nickel to unmount the FS
-		err = waitForUnmount(10)
-		chkErrFatal(err, "The Filesystem did not unmount. Aborting!", 5)
-		os.MkdirAll(tmpOnboardMnt, 0666)
-		// 'Plugging' in the USB and 'connecting' causes Nickel to unmount /mnt/onboard...
-		// Let's be naughty and remount it elsewhere so we can access the DB without Nickel interfering
-		err = syscall.Mount(internalMemoryDev, tmpOnboardMnt, "vfat", 0, "")
-		if err == nil {
-			// Attempt to open the DB
-			koboDBpath := filepath.Join(tmpOnboardMnt, ".kobo/KoboReader.sqlite")
-			koboDSN := "file:" + koboDBpath + "?cache=shared&mode=rw"
-			db, err := sql.Open("sqlite3", koboDSN)
-			if err != nil {
-				fbPrint(err.Error())
-				return
+		defer func() {
+			if level, err := batteryLevel(batteryPath); err == nil {
+				log.Printf("battery at %d%% after sync", level)
 			}
-			// Create a prepared statement we can reuse
-			stmt, err := db.Prepare("UPDATE content SET Description=?, Series=?, SeriesNumber=? WHERE ContentID LIKE ?")
-			if err == nil {
-				for _, meta := range metadata {
-					// Retrieve the values, and update the relevant records in the DB
-					path := meta.Lpath
-					series := meta.Series
-					seriesIndex := strconv.FormatFloat(meta.SeriesIndex, 'f', -1, 64)
-					description := meta.Comments
-
-					if path != "" {
-						_, err := stmt.Exec(description, series, seriesIndex, "%"+path)
-						if err != nil {
-							fbPrint("MD Error")
-						} else {
-							fbPrint("MD Success")
-						}
-					}
-				}
-			} else {
-				fbPrint(err.Error())
-			}
-			db.Close()
-			// We're done. Better unmount the filesystem before we return control to Nickel
-			syscall.Unmount(tmpOnboardMnt, 0)
-			// Make sure the FS is unmounted before returning control to Nickel
-			err = waitForUnmount(10)
-			chkErrFatal(err, "The Filesystem did not unmount. Aborting!", 5)
-			nickelUSBunplug()
-			fbPrint("Metadata updated!")
-		} else {
-			fbPrint(err.Error())
+		}()
+	} else {
+		logErrPrint(err)
+	}
+	if krCfg.RcloneCacheDir != "" {
+		if err := os.MkdirAll(krCfg.RcloneCacheDir, 0755); err != nil {
+			logErrPrint(err)
+			d.Println("Could not create rclone cache dir. Aborting!")
+			return 0, err
 		}
-
+	}
+	booksBefore := snapshotBookDir(ksDir)
+	// OAuth remotes write refreshed tokens back to the config file
+	if f, err := os.OpenFile(rcConf, os.O_WRONLY|os.O_APPEND, 0); err == nil {
+		f.Close()
 	} else {
-		fbPrint("No metadata to update!")
+		logErrPrint(err)
+		d.Println("Warning: rclone config is not writable!")
 	}
-}
-
-// syncBooks runs the rclone program using the preconfigered configuration file.
-func syncBooks(rcBin, rcConf, rcRemote, ksDir, krcloneDir string) {
-	if !strings.HasSuffix(rcRemote, ":") {
-		rcRemote += ":"
+	stopWifi, err := startWifi(d, krCfg)
+	if err != nil {
+		return 0, err
+	}
+	spinner := startSpinner(d, "Starting Sync... Please wait.", krCfg.SpinnerStyle)
+	syncCmd := exec.Command(rcBin, rcArgs...)
+	syncCmd.Env = rcloneEnv(krCfg)
+	var rcStderr bytes.Buffer
+	syncCmd.Stderr = &rcStderr
+	polls := 0
+	stopTimer := timePhase("rclone")
+	if krCfg.UseRcd {
+		err = runRcdSync(spinner, rcBin, rcArgs, &rcStderr, krCfg)
+	} else {
+		err = runPolling(syncCmd, time.Second, func() {
+			if polls++; polls%30 == 0 {
+				log.Printf("rclone running for %ds", polls)
+			}
+			if name := currentTransfer(rcLog); name != "" {
+				spinner.SetMessage("Syncing " + shortValue(filepath.Base(name)))
+			}
+		})
 	}
-	fbPrint("Starting Sync... Please wait.")
-	syncCmd := exec.Command(rcBin, "sync", rcRemote, ksDir, "--config", rcConf)
-	err := syncCmd.Run()
+	stopTimer()
+	if err == nil {
+		spinner.SetMessage("Sync complete.")
+	}
+	spinner.Stop()
+	stopWifi()
 	if err != nil {
-		fbPrint("Sync failed. Aborting!")
-		return
+		logTail(rcLog, 20, secrets(krCfg))
+		rcLogData, _ := ioutil.ReadFile(rcLog)
+		if isTokenError(rcStderr.String()) || isTokenError(string(rcLogData)) {
+			d.Println("Remote authorization expired - reconfigure rclone")
+			return 0, errors.New("remote authorization expired")
+		}
+		d.Println("Sync failed. Aborting!")
+		return 0, err
+	}
+	if krCfg.ExtractArchives {
+		extractArchives(d, ksDir, krcloneDir)
+	}
+	newBooks := changedFiles(booksBefore, snapshotBookDir(ksDir))
+	if krCfg.KepubifyBin != "" {
+		kepubifyBooks(d, resolvePath(krcloneDir, krCfg.KepubifyBin), ksDir, krcloneDir, newBooks, krCfg.KepubKeepOriginal)
+		// Without the originals, there's no telling which kepubs are orphaned
+		if krCfg.KepubKeepOriginal && krCfg.SyncMode == "sync" && !krCfg.IgnoreExisting {
+			if n := pruneKepubs(ksDir); n > 0 {
+				printLevel(d, levelNormal, fmt.Sprintf("Removed %d kepubs of deleted books", n))
+			}
+		}
+	}
+	if krCfg.GenerateCovers {
+		// book_storage was checked at startup
+		storageMnt, _ := storageMount(krCfg.BookStorage)
+		// Converted books replace (or sit next to) the epubs that were synced
+		var books []string
+		for _, book := range newBooks {
+			for _, b := range []string{book, kepubLpath(book)} {
+				if _, err := os.Stat(b); b != "" && err == nil {
+					books = append(books, b)
+				}
+			}
+		}
+		generateCovers(d, filepath.Join(storageMnt, ".kobo-images"), ksDir, books, krCfg.CoverWorkers)
 	}
-	fbPrint("Simulating USB... Please wait.")
+	return len(newBooks), nil
+}
+
+// importBooks gets Nickel to import the synced books, by simulating a USB
+// connection. It is done once per run, after every book dir has synced.
+func importBooks(d Display, krCfg *KRcloneConfig) error {
+	printLevel(d, levelNormal, "Simulating USB... Please wait.")
 	// Sync has succeeded. We need Nickel to process the new files, so we simulate
 	// a USB connection. It turns out, 5 seconds may not be nearly long enough. Now
 	// set to approx 60 sec
 	nickelUSBplug()
-	for i := 0; i < 120; i++ {
-		err = fbButtonScan(true)
-		if i == 119 && err != nil {
-			fbPrint(err.Error())
-			logErrPrint(err)
-			return
-		}
-		if err == nil {
-			break
-		}
+	err := pressConnectButton(d, 120, krCfg, func(i int) {
 		if i%2 == 0 {
 			msg := fmt.Sprintf("We've been waiting for %d iterations", i)
-			fbPrint(msg)
+			printLevel(d, levelDebug, msg)
 		}
-		time.Sleep(500 * time.Millisecond)
+	})
+	if err != nil {
+		d.Println(err.Error())
+		logErrPrint(err)
+		return err
 	}
 	time.Sleep(5 * time.Second)
 	nickelUSBunplug()
-	fbPrint("Done! Please rerun to update metadata.")
-	waitForMount(30)
-	// Create the lock file to inform our program to get the metadata on next run
-	f, _ := os.Create(filepath.Join(krcloneDir, metaLockFile))
-	defer f.Close()
-	fbPrint(" ")
+	if krCfg.SingleRun {
+		d.Println("Sync done!")
+	} else {
+		d.Println("Done! Please rerun to update metadata.")
+	}
+	if _, err = waitForMount(d, krCfg.RemountTimeoutSec); err != nil {
+		// Some devices need another nudge, and longer, to remount
+		log.Printf("internal memory did not remount, unplugging again")
+		nickelUSBunplug()
+		if _, err = waitForMount(d, krCfg.RemountTimeoutSec*2); err != nil {
+			logErrPrint(err)
+			d.Println("Internal memory did not remount! Please restart your Kobo.")
+			return err
+		}
+	}
+	d.Println(" ")
+	return nil
 }
 
 func main() {
-	// Init FBInk before use
-	fbinkOpts.IsQuiet = true
-	fbinkOpts.Fontmult = 3
-	gofbink.Init(gofbink.FBFDauto, fbinkOpts)
+	useStdout := flag.Bool("stdout", false, "print status messages to stdout instead of the screen")
+	doCleanup := flag.Bool("cleanup", false, "recover from a crashed run, then exit")
+	metadataOnly := flag.Bool("metadata-only", false, "download just the metadata file, and update metadata without syncing books")
+	showInfo := flag.Bool("info", false, "show the resolved configuration, then exit")
+	assumeYes := flag.Bool("yes", false, "don't ask for confirmation on the first run")
+	fullMetadata := flag.Bool("full-metadata", false, "update metadata for every book, not just those that changed")
+	restartMetadata := flag.Bool("restart-metadata", false, "start an interrupted metadata update again from the beginning")
+	flag.BoolVar(&simulateDevice, "simulate-device", false, "fake the USB connection and remount, using a copy of the database in "+tmpOnboardMnt)
+	showStats := flag.Bool("stats", false, "show a summary of the books on the device, then exit")
+	runDoctor := flag.Bool("doctor", false, "check everything kobo-rclone needs is working, then exit")
+	doCaptureButton := flag.Bool("capture-button", false, "record a tap on the USB connect button into button_event_file, then exit")
+	doMountOnly := flag.Bool("mount-only", false, "remount the internal memory at "+tmpOnboardMnt+" until the screen is tapped, then exit")
+	dryRun := flag.Bool("dry-run", false, "show how many books the metadata update would change, without writing anything")
+	flag.Parse()
+
+	var d Display = fbinkDisplay{}
+	if *useStdout {
+		d = stdoutDisplay{}
+	}
+	// Init the display before use. If the screen can't be used, carry on
+	// headless, which is still useful over telnet/SSH
+	if err := d.Init(); err != nil {
+		log.Printf("display init failed, falling back to stdout: %s", err)
+		d = stdoutDisplay{}
+	}
+	logErrPrint(d.Open())
+	defer d.Close()
 	// Discover what directory we are running from
 	krcloneDir, err := os.Executable()
 	log.Printf(krcloneDir)
-	chkErrFatal(err, "Could not get current Directory. Aborting!", 5)
+	chkErrFatal(d, err, "Could not get current Directory. Aborting!", 5)
 	if !strings.HasPrefix(krcloneDir, onboardMnt) {
 		krcloneDir = filepath.Join(onboardMnt, krcloneDir)
 	}
 	krcloneDir, _ = filepath.Split(krcloneDir)
 	log.Printf(krcloneDir)
 
+	if *doCleanup {
+		cleanup(d, krcloneDir)
+		return
+	}
+	handleSignals(d)
+	// A missing rclone is the most common setup problem, so catch it before
+	// anything is done to the device. --info and --doctor report it themselves.
+	checkRclone := !*showInfo && !*runDoctor
+	rcloneBin := filepath.Join(krcloneDir, "rclone")
+	if checkRclone {
+		if err := checkRcloneBin(rcloneBin); err != nil {
+			log.Print(err)
+			d.Println(err.Error())
+			time.Sleep(5 * time.Second)
+			return
+		}
+	}
+
 	// Read Config file. TOML is used here. Binary size tradeoff not too bad
 	// here.
 	krCfgPath := filepath.Join(krcloneDir, "krclone-cfg.toml")
-	var krCfg KRcloneConfig
-	if _, err := toml.DecodeFile(krCfgPath, &krCfg); err != nil {
-		chkErrFatal(err, "Couldn't read config. Aborting!", 5)
+	if _, err := os.Stat(krCfgPath); os.IsNotExist(err) {
+		// Give new users a commented config to start from
+		err := ioutil.WriteFile(krCfgPath, []byte(defaultConfigTemplate), 0644)
+		chkErrFatal(d, err, "Couldn't create a default config. Aborting!", 5)
+		log.Printf("created default config %s", krCfgPath)
+		d.Println("Created default config — please edit it")
+		time.Sleep(5 * time.Second)
+		return
 	}
-
-	// Run kobo-rclone with our configured settings
-	rcloneBin := filepath.Join(krcloneDir, "rclone")
+	krCfg := defaultConfig()
+	md, err := toml.DecodeFile(krCfgPath, &krCfg)
+	if err != nil {
+		chkErrFatal(d, err, "Couldn't read config. Aborting!", 5)
+	}
+	// Not fatal, the defaults for new options are used either way
+	if err := migrateConfig(krCfgPath, md, &krCfg); err != nil {
+		logErrPrint(err)
+		d.Println("Could not update config file.")
+	}
+	// rclone_config is always taken from the local config
 	rcloneConfig := filepath.Join(krcloneDir, krCfg.RcloneCfg)
-	bookDir := filepath.Join(onboardMnt, krCfg.KRbookDir)
-	if metadataLockfileExists(krcloneDir) {
-		updateMetadata(bookDir, krcloneDir)
+	if checkRclone {
+		if err := checkRcloneFiles(rcloneBin, rcloneConfig); err != nil {
+			log.Print(err)
+			d.Println(err.Error())
+			time.Sleep(5 * time.Second)
+			return
+		}
+	}
+	// The remote config is found relative to the first remote dir
+	krCfg.selectBookDir(0)
+	if krCfg.RemoteConfig != "" && !*showInfo {
+		// A bad remote config must never stop us working with the local one
+		if err := fetchRemoteConfig(d, krcloneDir, &krCfg); err != nil {
+			logErrPrint(err)
+			d.Println("Could not use remote config. Using local config.")
+		}
+	}
+
+	if krCfg.StatusLines < 1 || krCfg.StatusLines > 20 {
+		log.Printf("status_lines must be between 1 and 20, using 5")
+		krCfg.StatusLines = 5
+	}
+	setMaxLines(krCfg.StatusLines)
+	verbosity = krCfg.Verbosity
+	errorMessageSec = krCfg.ErrorMessageSec
+	seriesIndexPad = krCfg.SeriesIndexPad
+	stripCommentsHTML = krCfg.StripCommentsHTML
+	onlyChangedMetadata = krCfg.OnlyChangedMetadata
+	bookExtensions = nil
+	for _, ext := range krCfg.BookExtensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		bookExtensions = append(bookExtensions, ext)
+	}
+	if !columnNameRegex.MatchString(krCfg.CommentsColumn) {
+		d.Println("Invalid comments_column \"" + krCfg.CommentsColumn + "\". Aborting!")
+		time.Sleep(5 * time.Second)
+		return
+	}
+	// Columns missing from this firmware's schema are skipped when updating
+	description := metadataFields["description"]
+	description.column = krCfg.CommentsColumn
+	metadataFields["description"] = description
+	metadataSettings = describeMetadataSettings(krCfg.MetadataFields, seriesIndexPad, stripCommentsHTML, krCfg.CommentsColumn)
+
+	if krCfg.TouchEventDevice == "" {
+		krCfg.TouchEventDevice = detectTouchDevice()
+	}
+	log.Printf("using touch device %s", krCfg.TouchEventDevice)
+	touchDevice = krCfg.TouchEventDevice
+	if krCfg.ButtonEventFile != "" {
+		krCfg.ButtonEventFile = resolvePath(krcloneDir, krCfg.ButtonEventFile)
+	} else if _, err := os.Stat(filepath.Join(krcloneDir, defaultButtonEventFile)); err == nil {
+		// Left by --capture-button
+		krCfg.ButtonEventFile = filepath.Join(krcloneDir, defaultButtonEventFile)
+	}
+	if krCfg.ButtonEventFile != "" {
+		log.Printf("connect button taps replayed from %s through %s", krCfg.ButtonEventFile, krCfg.TouchEventDevice)
+	}
 
+	// Run kobo-rclone with our configured settings
+	storageMnt, err := storageMount(krCfg.BookStorage)
+	if err != nil {
+		d.Println(err.Error() + ". Aborting!")
+		time.Sleep(5 * time.Second)
+		return
+	}
+	if _, err := os.Stat(storageMnt); err != nil || (storageMnt == sdMnt && sameFilesystem(sdMnt, "/")) {
+		// Don't sync to the root filesystem under an empty mountpoint
+		d.Println("Storage " + storageMnt + " not mounted. Aborting!")
+		time.Sleep(5 * time.Second)
+		return
+	}
+	if len(krCfg.BookDirs) > 1 && len(krCfg.RootDirs) != len(krCfg.BookDirs) {
+		d.Println("krclone_book_dir and rclone_root_dir need the same number of dirs. Aborting!")
+		time.Sleep(5 * time.Second)
+		return
+	}
+	var pairs []bookDirPair
+	for i, dir := range krCfg.BookDirs {
+		pair := bookDirPair{cfg: krCfg, bookDir: filepath.Join(storageMnt, dir), stateDir: krcloneDir}
+		pair.cfg.selectBookDir(i)
+		if i > 0 {
+			pair.stateDir = filepath.Join(krcloneDir, "dir-state", strings.Replace(filepath.Clean(dir), "/", "_", -1))
+		}
+		// Resolve symlinks, so ContentIDs are computed from the real path
+		if resolved, err := filepath.EvalSymlinks(pair.bookDir); err == nil && resolved != pair.bookDir {
+			log.Printf("book dir %s resolves to %s", pair.bookDir, resolved)
+			pair.bookDir = resolved
+			if storageMnt == onboardMnt && !sameFilesystem(pair.bookDir, onboardMnt) {
+				// The metadata update remounts the internal memory, so can't see books elsewhere
+				d.Println("Warning: book dir is not on the internal memory!")
+			}
+		}
+		pairs = append(pairs, pair)
+	}
+	if len(pairs) == 0 {
+		d.Println("krclone_book_dir is not set. Aborting!")
+		time.Sleep(5 * time.Second)
+		return
+	}
+	bookDir := pairs[0].bookDir
+	if *showInfo {
+		printInfo(d, rcloneBin, rcloneConfig, pairs, &krCfg)
+		return
+	}
+	if *showStats {
+		runPhase(d, "stats", func(d Display) (int, error) {
+			return 0, libraryStats(d, &krCfg)
+		})
+		// Leave the stats on screen for a while
+		if _, onStdout := d.(stdoutDisplay); !onStdout {
+			time.Sleep(10 * time.Second)
+		}
+		return
+	}
+	if *runDoctor {
+		// Keep every check on screen
+		setMaxLines(20)
+		runPhase(d, "doctor", func(d Display) (int, error) {
+			return doctor(d, rcloneBin, rcloneConfig, bookDir, &krCfg), nil
+		})
+		if _, onStdout := d.(stdoutDisplay); !onStdout {
+			time.Sleep(20 * time.Second)
+		}
+		return
+	}
+	for _, pair := range pairs {
+		if _, err := os.Stat(pair.bookDir); os.IsNotExist(err) {
+			// Never create directories outside the user's storage, eg: from a ".." in the config
+			cleanDir := filepath.Clean(pair.bookDir) + "/"
+			if !strings.HasPrefix(cleanDir, onboardMnt) && !strings.HasPrefix(cleanDir, sdMnt) {
+				d.Println("Book dir is outside the Kobo's storage. Aborting!")
+				time.Sleep(5 * time.Second)
+				return
+			}
+			if err := os.MkdirAll(pair.bookDir, 0755); err != nil {
+				logErrPrint(err)
+				d.Println("Could not create book dir. Aborting!")
+				time.Sleep(5 * time.Second)
+				return
+			}
+			log.Printf("created book dir %s", pair.bookDir)
+		}
+		logErrPrint(os.MkdirAll(pair.stateDir, 0755))
+	}
+	if krCfg.FilterFile != "" {
+		krCfg.FilterFile = resolvePath(krcloneDir, krCfg.FilterFile)
+		if _, err := os.Stat(krCfg.FilterFile); err != nil {
+			log.Print(err)
+			d.Println("Filter file " + filepath.Base(krCfg.FilterFile) + " not found. Aborting!")
+			time.Sleep(5 * time.Second)
+			return
+		}
+	}
+	if krCfg.RcloneCacheDir != "" {
+		krCfg.RcloneCacheDir = resolvePath(krcloneDir, krCfg.RcloneCacheDir)
+	}
+	if *doCaptureButton {
+		eventFile := krCfg.ButtonEventFile
+		if eventFile == "" {
+			eventFile = filepath.Join(krcloneDir, defaultButtonEventFile)
+		}
+		if err := captureButton(d, &krCfg, eventFile); err != nil {
+			logErrPrint(err)
+			d.Println("Could not capture tap: " + err.Error())
+		}
+		time.Sleep(5 * time.Second)
+		return
+	}
+	if *doMountOnly {
+		if err := mountOnly(d, &krCfg); err != nil {
+			logErrPrint(err)
+		}
+		time.Sleep(3 * time.Second)
+		return
+	}
+	if version, err := detectRcloneVersion(rcloneBin); err == nil {
+		rcloneVersion = version
+		log.Printf("rclone version %s", version)
+		if !versionAtLeast(version, minRcloneVersion) {
+			d.Println("Warning: rclone " + version + " is old. Some features may not work.")
+		}
+	} else {
+		logErrPrint(err)
+	}
+	// Each pair's config picks up the paths resolved above
+	for i := range pairs {
+		pairs[i].cfg = krCfg
+		pairs[i].cfg.selectBookDir(i)
+	}
+	opts := runOptions{fullMetadata: *fullMetadata, restartMetadata: *restartMetadata, dryRun: *dryRun}
+	runState := currentRunState(krcloneDir)
+	log.Printf("run state %s", runState)
+	// forEachDir runs fn for each book dir in turn, stopping at the first error
+	forEachDir := func(fn func(pair *bookDirPair) (int, error)) (int, error) {
+		total := 0
+		for i := range pairs {
+			if len(pairs) > 1 {
+				d.Println(fmt.Sprintf("Book dir %d/%d: %s", i+1, len(pairs), pairs[i].cfg.KRbookDir))
+			}
+			n, err := fn(&pairs[i])
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		return total, nil
+	}
+	// runMetadata runs the metadata phase, then uploads any annotations
+	// There is one run state for the whole run, so a failure in any book dir
+	// retries them all. Books already updated are skipped as unchanged.
+	runMetadata := func(start time.Time) {
+		setRunState(krcloneDir, stateUpdatingMetadata)
+		stopTimer := timePhase("metadata")
+		updated, err := forEachDir(func(pair *bookDirPair) (int, error) {
+			updated, err := runPhase(d, "metadata", func(d Display) (int, error) {
+				return updateMetadata(d, pair.bookDir, pair.stateDir, &pair.cfg, opts)
+			})
+			if err == nil && pair.cfg.SyncAnnotations {
+				if err := pushAnnotations(d, rcloneBin, rcloneConfig, pair.bookDir, &pair.cfg); err != nil {
+					d.Println("Could not upload annotations.")
+				}
+			}
+			return updated, err
+		})
+		d.Println("Metadata took " + stopTimer().Round(time.Second).String())
+		if err != nil && krCfg.RetryMetadataOnFailure {
+			log.Printf("metadata update will be retried")
+			setRunState(krcloneDir, stateAwaitingMetadata)
+		} else {
+			setRunState(krcloneDir, stateIdle)
+		}
+		writeResult(krcloneDir, "metadata", start, updated, err)
+	}
+	// pullMetadataFiles downloads the metadata file for each book dir
+	pullMetadataFiles := func() error {
+		_, err := forEachDir(func(pair *bookDirPair) (int, error) {
+			return 0, pullMetadataFile(d, rcloneBin, rcloneConfig, pair.bookDir, &pair.cfg)
+		})
+		return err
+	}
+	start := time.Now()
+	if *dryRun {
+		forEachDir(func(pair *bookDirPair) (int, error) {
+			return runPhase(d, "metadata", func(d Display) (int, error) {
+				return updateMetadata(d, pair.bookDir, pair.stateDir, &pair.cfg, opts)
+			})
+		})
+	} else if *metadataOnly {
+		if err := pullMetadataFiles(); err != nil {
+			d.Println("Could not fetch metadata file. Aborting!")
+			writeResult(krcloneDir, "metadata", start, 0, err)
+			return
+		}
+		runMetadata(start)
+	} else if runState == stateAwaitingMetadata || runState == stateUpdatingMetadata {
+		if runState == stateUpdatingMetadata {
+			d.Println("Resuming interrupted metadata update.")
+		}
+		if krCfg.RefreshMetadataFile {
+			// Not fatal, as we may still have an older copy of the metadata file
+			if err := pullMetadataFiles(); err != nil {
+				d.Println("Could not refresh metadata file. Using local copy.")
+			}
+		}
+		runMetadata(start)
 	} else {
-		syncBooks(rcloneBin, rcloneConfig, krCfg.RCremoteName, bookDir, krcloneDir)
+		// Give first time users a chance to spot a misconfigured remote
+		if _, err := os.Stat(filepath.Join(krcloneDir, stateFile)); os.IsNotExist(err) && !*assumeYes {
+			if !confirmConfig(d, pairs, &krCfg) {
+				d.Println("Sync cancelled.")
+				return
+			}
+			logErrPrint(saveState(krcloneDir, loadState(krcloneDir)))
+		}
+		if runState == stateSyncing {
+			d.Println("Previous sync was interrupted. Syncing again.")
+		}
+		stopTimer := timePhase("sync")
+		if krCfg.SyncMode != "mount" {
+			setRunState(krcloneDir, stateSyncing)
+		}
+		synced, err := forEachDir(func(pair *bookDirPair) (int, error) {
+			return runPhase(d, "sync", func(d Display) (int, error) {
+				return syncBooks(d, rcloneBin, rcloneConfig, pair.bookDir, krcloneDir, &pair.cfg)
+			})
+		})
+		if err == nil && krCfg.SyncMode != "mount" {
+			// Nickel imports the books of every book dir in one USB session
+			_, err = runPhase(d, "sync", func(d Display) (int, error) {
+				return 0, importBooks(d, &krCfg)
+			})
+		}
+		d.Println("Sync took " + stopTimer().Round(time.Second).String())
+		if err != nil {
+			setRunState(krcloneDir, stateIdle)
+		} else if krCfg.SyncMode != "mount" {
+			// The next run gets the metadata
+			setRunState(krcloneDir, stateAwaitingMetadata)
+		}
+		writeResult(krcloneDir, "sync", start, synced, err)
+		// The metadata update would unmount the remote again straight away
+		if err == nil && krCfg.SingleRun && krCfg.SyncMode != "mount" {
+			// Go straight on to the metadata, rather than waiting for another run
+			runMetadata(time.Now())
+		}
 	}
 }
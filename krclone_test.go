@@ -0,0 +1,882 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// argIndex returns the position of flag followed by value in args, or -1
+func argIndex(args []string, flag, value string) int {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag && args[i+1] == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestBuildSyncArgsFilterOrder(t *testing.T) {
+	ksDir := t.TempDir()
+	krcloneDir := t.TempDir()
+	ignorePath := filepath.Join(ksDir, krIgnoreFile)
+	extractedPath := filepath.Join(krcloneDir, extractedFile)
+	convertedPath := filepath.Join(krcloneDir, convertedFile)
+	for _, path := range []string{ignorePath, extractedPath, convertedPath} {
+		if err := ioutil.WriteFile(path, []byte("Samples/**\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The filter file is where include rules come from
+	filterPath := filepath.Join(krcloneDir, "filter.txt")
+	krCfg := defaultConfig()
+	krCfg.ExcludePaths = []string{"Samples/**", " ", "*.sdr/**"}
+	krCfg.ExtractArchives = true
+	krCfg.KepubifyBin = "kepubify"
+	krCfg.KepubKeepOriginal = false
+	krCfg.FilterFile = filterPath
+	args := buildSyncArgs("krclone:", ksDir, krcloneDir, "rclone.conf", &krCfg)
+
+	filterIndex := argIndex(args, "--filter-from", filterPath)
+	if filterIndex < 0 {
+		t.Fatalf("no --filter-from in %v", args)
+	}
+	excludes := []struct {
+		flag, value string
+	}{
+		{"--exclude", "Samples/**"},
+		{"--exclude", "*.sdr/**"},
+		{"--exclude", "/" + krIgnoreFile},
+		{"--exclude-from", ignorePath},
+		{"--exclude-from", extractedPath},
+		{"--exclude", "*.kepub.epub"},
+		{"--exclude-from", convertedPath},
+	}
+	last := -1
+	for _, ex := range excludes {
+		i := argIndex(args, ex.flag, ex.value)
+		switch {
+		case i < 0:
+			t.Errorf("%s %s missing from %v", ex.flag, ex.value, args)
+		case i > filterIndex:
+			t.Errorf("%s %s comes after the filter file in %v", ex.flag, ex.value, args)
+		case i < last:
+			t.Errorf("%s %s out of order in %v", ex.flag, ex.value, args)
+		}
+		last = i
+	}
+	if argIndex(args, "--exclude", " ") >= 0 {
+		t.Errorf("blank exclude pattern passed to rclone: %v", args)
+	}
+	for i, arg := range args {
+		if (arg == "--include" || arg == "--include-from") && i < last {
+			t.Errorf("include rule before an exclude in %v", args)
+		}
+	}
+}
+
+func TestEncodeLpath(t *testing.T) {
+	tests := []struct {
+		lpath, want string
+	}{
+		{"Book.epub", "Book.epub"},
+		{"My Books/The Book.epub", "My%20Books/The%20Book.epub"},
+		{"Author/Ender's Game.epub", "Author/Ender%27s%20Game.epub"},
+		{"Café/Über.epub", "Caf%C3%A9/%C3%9Cber.epub"},
+		{"日本/本.kepub.epub", "%E6%97%A5%E6%9C%AC/%E6%9C%AC.kepub.epub"},
+		{"file:///mnt/onboard/krclone-books/A B.epub", "file:///mnt/onboard/krclone-books/A%20B.epub"},
+	}
+	for _, tt := range tests {
+		if got := encodeLpath(tt.lpath); got != tt.want {
+			t.Errorf("encodeLpath(%q) = %q, want %q", tt.lpath, got, tt.want)
+		}
+	}
+}
+
+func TestLpathContentIDNested(t *testing.T) {
+	tests := []struct {
+		lpath, want string
+	}{
+		{"Book.epub", "file:///mnt/onboard/krclone-books/Book.epub"},
+		{"Author/Book.epub", "file:///mnt/onboard/krclone-books/Author/Book.epub"},
+		{"Author/Series/Book 1.epub", "file:///mnt/onboard/krclone-books/Author/Series/Book 1.epub"},
+		// Calibre's lpaths are relative, but tidy them up anyway
+		{"./Author//Series/Book.epub", "file:///mnt/onboard/krclone-books/Author/Series/Book.epub"},
+	}
+	for _, tt := range tests {
+		if got := lpathContentID("/mnt/onboard/krclone-books", tt.lpath); got != tt.want {
+			t.Errorf("lpathContentID(%q) = %q, want %q", tt.lpath, got, tt.want)
+		}
+	}
+}
+
+func TestCoverImageDir(t *testing.T) {
+	// Checked against calibre's Kobo driver, which writes covers the same way
+	tests := []struct {
+		contentID, imageID, dir string
+	}{
+		{"file:///mnt/onboard/krclone-books/Author/Book One.epub", "file____mnt_onboard_krclone-books_Author_Book_One_epub", "242/22"},
+		{"file:///mnt/sd/Book.kepub.epub", "file____mnt_sd_Book_kepub_epub", "114/127"},
+	}
+	for _, tt := range tests {
+		dir, imageID := coverImageDir("/mnt/onboard/.kobo-images", tt.contentID)
+		if want := "/mnt/onboard/.kobo-images/" + tt.dir; dir != want || imageID != tt.imageID {
+			t.Errorf("coverImageDir(%q) = %q, %q, want %q, %q", tt.contentID, dir, imageID, want, tt.imageID)
+		}
+	}
+}
+
+// writeTestEpub writes an epub with a 600x800 PNG cover, found through the
+// given OPF. Only the parts needed to find the cover are included.
+func writeTestEpub(t *testing.T, bookPath, opf string) {
+	t.Helper()
+	cover := image.NewRGBA(image.Rect(0, 0, 600, 800))
+	for y := 0; y < 800; y++ {
+		for x := 0; x < 600; x++ {
+			cover.Set(x, y, color.RGBA{200, 100, 50, 255})
+		}
+	}
+	var coverPNG bytes.Buffer
+	if err := png.Encode(&coverPNG, cover); err != nil {
+		t.Fatal(err)
+	}
+	var epub bytes.Buffer
+	zw := zip.NewWriter(&epub)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"META-INF/container.xml", []byte(`<?xml version="1.0"?><container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`)},
+		{"OEBPS/content.opf", []byte(opf)},
+		{"OEBPS/images/cover image.png", coverPNG.Bytes()},
+	}
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bookPath, epub.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateCovers(t *testing.T) {
+	opfs := []struct {
+		name, opf string
+	}{
+		{"epub3", `<package xmlns="http://www.idpf.org/2007/opf" version="3.0"><metadata/><manifest>
+			<item id="img" href="images/cover%20image.png" media-type="image/png" properties="cover-image"/>
+		</manifest></package>`},
+		{"epub2", `<package xmlns="http://www.idpf.org/2007/opf" version="2.0"><metadata><meta name="cover" content="img"/></metadata><manifest>
+			<item id="img" href="images/cover%20image.png" media-type="image/png"/>
+		</manifest></package>`},
+	}
+	ksDir := t.TempDir()
+	imagesDir := t.TempDir()
+	var books []string
+	for _, o := range opfs {
+		bookPath := filepath.Join(ksDir, o.name+".epub")
+		writeTestEpub(t, bookPath, o.opf)
+		books = append(books, bookPath)
+	}
+	// Not an epub, so skipped
+	books = append(books, filepath.Join(ksDir, "Book.pdf"))
+	// No cover, so it fails without stopping the others
+	noCover := filepath.Join(ksDir, "nocover.epub")
+	writeTestEpub(t, noCover, `<package version="3.0"><metadata/><manifest/></package>`)
+	books = append(books, noCover)
+
+	d := &nopDisplay{}
+	if n := generateCovers(d, imagesDir, ksDir, books, 2); n != len(opfs) {
+		t.Errorf("generated %d covers, want %d", n, len(opfs))
+	}
+	if last := d.Messages[len(d.Messages)-1]; last != "Generated covers for 2 of 3 books" {
+		t.Errorf("last message %q", last)
+	}
+	for _, o := range opfs {
+		coverDir, imageID := coverImageDir(imagesDir, lpathContentID(ksDir, o.name+".epub"))
+		for _, size := range coverSizes {
+			f, err := os.Open(filepath.Join(coverDir, imageID+size.suffix))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			cfg, err := jpeg.DecodeConfig(f)
+			f.Close()
+			if err != nil {
+				t.Errorf("%s%s: %s", o.name, size.suffix, err)
+				continue
+			}
+			// The 3:4 cover is scaled to fit, keeping its aspect ratio
+			fits := cfg.Width <= size.width && cfg.Height <= size.height
+			fills := cfg.Width >= size.width-1 || cfg.Height >= size.height-1
+			aspect := math.Abs(float64(cfg.Height)-float64(cfg.Width)*4/3) <= 1
+			if !fits || !fills || !aspect {
+				t.Errorf("%s%s is %dx%d, want 3:4 filling %dx%d", o.name, size.suffix, cfg.Width, cfg.Height, size.width, size.height)
+			}
+		}
+	}
+}
+
+func TestCountCovers(t *testing.T) {
+	db := newTestDB(t, []testBook{
+		{contentID: testIDPrefix + "/With.epub"},
+		{contentID: testIDPrefix + "/Without.epub"},
+		{contentID: "file://" + sdMnt + "books/SD.epub"},
+		{contentID: testIDPrefix + "/NoImageID.epub"},
+	})
+	if _, err := db.Exec("ALTER TABLE content ADD COLUMN ImageId TEXT"); err != nil {
+		t.Fatal(err)
+	}
+	// Nickel sets the ImageId whether or not there is a cover
+	if _, err := db.Exec("UPDATE content SET ImageId = replace(replace(replace(ContentID, '/', '_'), ':', '_'), '.', '_') WHERE ContentID NOT LIKE '%NoImageID%'"); err != nil {
+		t.Fatal(err)
+	}
+	onboardImages, sdImages := t.TempDir(), t.TempDir()
+	for _, c := range []struct{ imagesDir, contentID string }{
+		{onboardImages, testIDPrefix + "/With.epub"},
+		{sdImages, "file://" + sdMnt + "books/SD.epub"},
+	} {
+		coverDir, imageID := coverImageDir(c.imagesDir, c.contentID)
+		if err := os.MkdirAll(coverDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(coverDir, imageID+coverSizes[0].suffix), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	with, without, err := countCovers(db, onboardImages, sdImages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if with != 2 || without != 2 {
+		t.Errorf("got %d with and %d without covers, want 2 and 2", with, without)
+	}
+}
+
+// testBookDir is the book directory the test database's ContentIDs point into
+const testBookDir = "/mnt/onboard/krclone-books"
+
+// testIDPrefix starts the ContentID of every book in testBookDir
+const testIDPrefix = "file://" + testBookDir
+
+// testBook is a row in the test database's content table
+type testBook struct {
+	contentID   string
+	title       string
+	attribution string
+}
+
+// newTestDB creates a minimal KoboReader.sqlite in a temporary directory,
+// holding the given books
+func newTestDB(t *testing.T, books []testBook) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "KoboReader.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`CREATE TABLE content (
+		ContentID TEXT NOT NULL,
+		ContentType TEXT NOT NULL,
+		Title TEXT,
+		Attribution TEXT,
+		Description TEXT,
+		Series TEXT,
+		SeriesNumber TEXT,
+		Rating INTEGER,
+		PRIMARY KEY (ContentID, ContentType)
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range books {
+		_, err = db.Exec("INSERT INTO content (ContentID, ContentType, Title, Attribution) VALUES (?, 6, ?, ?)", b.contentID, b.title, b.attribution)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// loadTestMetadata writes the fixture as a .metadata.calibre file, and reads
+// it back the way updateMetadata does
+func loadTestMetadata(t *testing.T, fixture string) []BookMetadata {
+	t.Helper()
+	mdPath := filepath.Join(t.TempDir(), ".metadata.calibre")
+	if err := ioutil.WriteFile(mdPath, []byte(fixture), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mdJSON, err := ioutil.ReadFile(mdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata []BookMetadata
+	if err := json.Unmarshal(mdJSON, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+// descriptions returns each book's description, by ContentID. Books without
+// one are left out.
+func descriptions(t *testing.T, db *sql.DB) map[string]string {
+	t.Helper()
+	rows, err := db.Query("SELECT ContentID, Description FROM content WHERE Description IS NOT NULL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	descs := make(map[string]string)
+	for rows.Next() {
+		var id, desc string
+		if err := rows.Scan(&id, &desc); err != nil {
+			t.Fatal(err)
+		}
+		descs[id] = desc
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return descs
+}
+
+// checkDescriptions fails the test unless exactly the expected books have a
+// description
+func checkDescriptions(t *testing.T, db *sql.DB, want map[string]string) {
+	t.Helper()
+	got := descriptions(t, db)
+	for id, desc := range want {
+		if got[id] != desc {
+			t.Errorf("description of %s = %q, want %q", id, got[id], desc)
+		}
+	}
+	for id, desc := range got {
+		if _, ok := want[id]; !ok {
+			t.Errorf("unexpected description %q written to %s", desc, id)
+		}
+	}
+}
+
+func newTestState() *KRcloneState {
+	return &KRcloneState{MetadataHashes: make(map[string]string), LastSeen: make(map[string]time.Time)}
+}
+
+func TestApplyMetadata(t *testing.T) {
+	const fixture = `[
+		{"lpath": "Author/Book One.epub", "title": "Book One", "authors": ["A. Author"], "comments": "First", "series": "Saga", "series_index": 1},
+		{"lpath": "Renamed.epub", "title": "Book Two", "authors": ["A. Author", "B. Author"], "comments": "Second"},
+		{"lpath": "Missing.epub", "title": "Not On Device", "authors": ["C. Author"], "comments": "Third"}
+	]`
+	books := []testBook{
+		{testIDPrefix + "/Author/Book One.epub", "Book One", "A. Author"},
+		// Renamed on the device, so only the title/author fallback finds it
+		{testIDPrefix + "/Book Two.epub", "Book Two", "A. Author & B. Author"},
+		{testIDPrefix + "/Other.epub", "Other", "D. Author"},
+	}
+	fields := []string{"description", "series", "seriesindex"}
+
+	tests := []struct {
+		name  string
+		match matchOptions
+		want  map[string]string
+	}{
+		{"content id", matchOptions{}, map[string]string{
+			testIDPrefix + "/Author/Book One.epub": "First",
+		}},
+		{"title and author fallback", matchOptions{fallback: true}, map[string]string{
+			testIDPrefix + "/Author/Book One.epub": "First",
+			testIDPrefix + "/Book Two.epub":        "Second",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t, books)
+			metadata := loadTestMetadata(t, fixture)
+			state := newTestState()
+			attempted, failed, err := applyMetadata(&nopDisplay{}, db, testBookDir, metadata, fields, state, false, tt.match, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attempted != len(metadata) || len(failed) != 0 {
+				t.Errorf("attempted %d, failed %v, want %d attempted and none failed", attempted, failed, len(metadata))
+			}
+			checkDescriptions(t, db, tt.want)
+			// Only books found in the database are remembered, so the rest are retried
+			if len(state.MetadataHashes) != len(tt.want) {
+				t.Errorf("%d metadata hashes recorded, want %d", len(state.MetadataHashes), len(tt.want))
+			}
+		})
+	}
+
+	t.Run("series", func(t *testing.T) {
+		db := newTestDB(t, books)
+		metadata := loadTestMetadata(t, fixture)
+		if _, _, err := applyMetadata(&nopDisplay{}, db, testBookDir, metadata, fields, newTestState(), false, matchOptions{}, ""); err != nil {
+			t.Fatal(err)
+		}
+		var series, number string
+		err := db.QueryRow("SELECT Series, SeriesNumber FROM content WHERE ContentID = ?", testIDPrefix+"/Author/Book One.epub").Scan(&series, &number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if series != "Saga" || number != "1" {
+			t.Errorf("series = %q #%q, want \"Saga\" #\"1\"", series, number)
+		}
+	})
+
+	t.Run("unchanged books skipped", func(t *testing.T) {
+		db := newTestDB(t, books)
+		metadata := loadTestMetadata(t, fixture)
+		state := newTestState()
+		state.MetadataHashes[metadata[0].Lpath] = metadataHash(metadata[0])
+		attempted, _, err := applyMetadata(&nopDisplay{}, db, testBookDir, metadata, fields, state, false, matchOptions{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempted != len(metadata)-1 {
+			t.Errorf("attempted %d, want %d", attempted, len(metadata)-1)
+		}
+		checkDescriptions(t, db, map[string]string{})
+	})
+
+	t.Run("empty metadata", func(t *testing.T) {
+		db := newTestDB(t, books)
+		attempted, failed, err := applyMetadata(&nopDisplay{}, db, testBookDir, nil, fields, newTestState(), false, matchOptions{}, "")
+		if attempted != 0 || len(failed) != 0 || err != nil {
+			t.Errorf("applyMetadata = %d, %v, %v, want nothing done", attempted, failed, err)
+		}
+	})
+}
+
+func TestApplyMetadataResume(t *testing.T) {
+	const fixture = `[
+		{"lpath": "One.epub", "comments": "First"},
+		{"lpath": "Two.epub", "comments": "Second"},
+		{"lpath": "Three.epub", "comments": "Third"}
+	]`
+	books := []testBook{
+		{testIDPrefix + "/One.epub", "One", ""},
+		{testIDPrefix + "/Two.epub", "Two", ""},
+		{testIDPrefix + "/Three.epub", "Three", ""},
+	}
+	tests := []struct {
+		name     string
+		progress metadataProgress
+		want     map[string]string
+	}{
+		{"resumed after the last committed book", metadataProgress{Index: 0, Lpath: "One.epub"}, map[string]string{
+			testIDPrefix + "/Two.epub":   "Second",
+			testIDPrefix + "/Three.epub": "Third",
+		}},
+		// The metadata changed since, so the whole update is run again
+		{"stale progress ignored", metadataProgress{Index: 0, Lpath: "Gone.epub"}, map[string]string{
+			testIDPrefix + "/One.epub":   "First",
+			testIDPrefix + "/Two.epub":   "Second",
+			testIDPrefix + "/Three.epub": "Third",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t, books)
+			metadata := loadTestMetadata(t, fixture)
+			progressPath := filepath.Join(t.TempDir(), progressFile)
+			if err := saveProgress(progressPath, tt.progress); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := applyMetadata(&nopDisplay{}, db, testBookDir, metadata, []string{"description"}, newTestState(), false, matchOptions{}, progressPath); err != nil {
+				t.Fatal(err)
+			}
+			checkDescriptions(t, db, tt.want)
+			if _, err := os.Stat(progressPath); !os.IsNotExist(err) {
+				t.Errorf("progress file left behind after a complete update")
+			}
+		})
+	}
+}
+
+func TestApplyMetadataWildcards(t *testing.T) {
+	// "%" and "_" are LIKE wildcards, so a pattern match would update the
+	// lookalike books too
+	tests := []struct {
+		name  string
+		lpath string
+	}{
+		{"underscore", "Book_One.epub"},
+		{"percent", "100% Done.epub"},
+		{"both", "50%_off/a_b.epub"},
+	}
+	books := []testBook{
+		{testIDPrefix + "/Book_One.epub", "", ""},
+		{testIDPrefix + "/BookXOne.epub", "", ""},
+		{testIDPrefix + "/100% Done.epub", "", ""},
+		{testIDPrefix + "/100% Is Done.epub", "", ""},
+		{testIDPrefix + "/50%_off/a_b.epub", "", ""},
+		{testIDPrefix + "/50 percent off/aXb.epub", "", ""},
+		{testIDPrefix + "/Other/50%_off/a_b.epub", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t, books)
+			metadata := []BookMetadata{{Lpath: tt.lpath, Comments: "Updated"}}
+			if _, _, err := applyMetadata(&nopDisplay{}, db, testBookDir, metadata, []string{"description"}, newTestState(), false, matchOptions{}, ""); err != nil {
+				t.Fatal(err)
+			}
+			checkDescriptions(t, db, map[string]string{testIDPrefix + "/" + tt.lpath: "Updated"})
+		})
+	}
+}
+
+func TestKepubLpath(t *testing.T) {
+	tests := []struct {
+		lpath, want string
+	}{
+		{"Author/Book.epub", "Author/Book.kepub.epub"},
+		{"Author/Book.EPUB", "Author/Book.kepub.epub"},
+		{"Author/Book.kepub.epub", ""},
+		{"Author/Book.pdf", ""},
+		{"Author/epub", ""},
+	}
+	for _, tt := range tests {
+		if got := kepubLpath(tt.lpath); got != tt.want {
+			t.Errorf("kepubLpath(%q) = %q, want %q", tt.lpath, got, tt.want)
+		}
+	}
+}
+
+func TestApplyMetadataKepub(t *testing.T) {
+	books := []testBook{{testIDPrefix + "/Author/Book.kepub.epub", "Book", ""}}
+	tests := []struct {
+		name       string
+		kepubAware bool
+		want       map[string]string
+	}{
+		{"kepub aware", true, map[string]string{testIDPrefix + "/Author/Book.kepub.epub": "Converted"}},
+		{"kepub unaware", false, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t, books)
+			metadata := []BookMetadata{{Lpath: "Author/Book.epub", Comments: "Converted"}}
+			match := matchOptions{kepubAware: tt.kepubAware}
+			if _, _, err := applyMetadata(&nopDisplay{}, db, testBookDir, metadata, []string{"description"}, newTestState(), false, match, ""); err != nil {
+				t.Fatal(err)
+			}
+			checkDescriptions(t, db, tt.want)
+		})
+	}
+}
+
+func TestStateBooks(t *testing.T) {
+	seen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	one := BookMetadata{Lpath: "One.epub", Title: "One"}
+	two := BookMetadata{Lpath: "Two.epub", Title: "Two"}
+	twoEdited := BookMetadata{Lpath: "Two.epub", Title: "Two, Revised"}
+	three := BookMetadata{Lpath: "Three.epub", Title: "Three"}
+
+	// The state as left by a run that wrote books one and two
+	newState := func() KRcloneState {
+		state := *newTestState()
+		state.MetadataHashes[one.Lpath] = metadataHash(one)
+		state.MetadataHashes[two.Lpath] = metadataHash(two)
+		markSeen(&state, []BookMetadata{one, two}, seen)
+		return state
+	}
+	tests := []struct {
+		name          string
+		metadata      []BookMetadata
+		changed, gone []string
+	}{
+		{"unchanged", []BookMetadata{one, two}, nil, nil},
+		{"added", []BookMetadata{one, two, three}, []string{"Three.epub"}, nil},
+		{"edited", []BookMetadata{one, twoEdited}, []string{"Two.epub"}, nil},
+		{"removed", []BookMetadata{one}, nil, []string{"Two.epub"}},
+		{"added and removed", []BookMetadata{three}, []string{"Three.epub"}, []string{"One.epub", "Two.epub"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, gone := diffState(newState(), tt.metadata)
+			sort.Strings(gone)
+			if !reflect.DeepEqual(changed, tt.changed) || !reflect.DeepEqual(gone, tt.gone) {
+				t.Errorf("diffState = %v changed, %v removed, want %v and %v", changed, gone, tt.changed, tt.gone)
+			}
+		})
+	}
+
+	t.Run("forgotten", func(t *testing.T) {
+		state := newState()
+		forgetBooks(&state, []string{two.Lpath})
+		if _, ok := state.MetadataHashes[two.Lpath]; ok {
+			t.Errorf("metadata hash kept for forgotten book")
+		}
+		if _, ok := state.LastSeen[two.Lpath]; ok {
+			t.Errorf("last seen time kept for forgotten book")
+		}
+		if state.MetadataHashes[one.Lpath] == "" || state.LastSeen[one.Lpath].IsZero() {
+			t.Errorf("book that wasn't forgotten is missing from the state")
+		}
+		// A forgotten book is new again if it comes back
+		if changed, _ := diffState(state, []BookMetadata{one, two}); !reflect.DeepEqual(changed, []string{"Two.epub"}) {
+			t.Errorf("diffState = %v changed, want [Two.epub]", changed)
+		}
+	})
+
+	t.Run("saved and loaded", func(t *testing.T) {
+		krcloneDir := t.TempDir()
+		state := newState()
+		if err := saveState(krcloneDir, state); err != nil {
+			t.Fatal(err)
+		}
+		loaded := loadState(krcloneDir)
+		if !reflect.DeepEqual(loaded.MetadataHashes, state.MetadataHashes) {
+			t.Errorf("loaded hashes %v, want %v", loaded.MetadataHashes, state.MetadataHashes)
+		}
+		if !loaded.LastSeen[one.Lpath].Equal(seen) {
+			t.Errorf("loaded last seen %v, want %v", loaded.LastSeen[one.Lpath], seen)
+		}
+	})
+
+	t.Run("missing state file", func(t *testing.T) {
+		state := loadState(t.TempDir())
+		if state.MetadataHashes == nil || state.LastSeen == nil || state.RunState != stateIdle {
+			t.Errorf("missing state file gave %+v, want an empty idle state", state)
+		}
+	})
+}
+
+func TestStorageContentID(t *testing.T) {
+	tests := []struct {
+		storage, bookDir, lpath, want string
+	}{
+		{"onboard", "krclone-books", "Author/Book.epub", "file:///mnt/onboard/krclone-books/Author/Book.epub"},
+		{"sd", "krclone-books", "Author/Book.epub", "file:///mnt/sd/krclone-books/Author/Book.epub"},
+		{"sd", "Books/Calibre", "Book.epub", "file:///mnt/sd/Books/Calibre/Book.epub"},
+	}
+	for _, tt := range tests {
+		mnt, err := storageMount(tt.storage)
+		if err != nil {
+			t.Fatalf("storageMount(%q): %s", tt.storage, err)
+		}
+		ksDir := filepath.Join(mnt, tt.bookDir)
+		if got := lpathContentID(ksDir, tt.lpath); got != tt.want {
+			t.Errorf("ContentID for %s on %s = %q, want %q", tt.lpath, tt.storage, got, tt.want)
+		}
+	}
+	if _, err := storageMount("usb"); err == nil {
+		t.Errorf("storageMount accepted an unknown storage")
+	}
+}
+
+func TestMetadataHashSettings(t *testing.T) {
+	defer func(settings string) { metadataSettings = settings }(metadataSettings)
+	meta := BookMetadata{Lpath: "Book.epub", Title: "Book"}
+	base := describeMetadataSettings([]string{"description", "series"}, 0, false, "Description")
+	tests := []struct {
+		name     string
+		settings string
+		same     bool
+	}{
+		{"same settings", base, true},
+		{"fields reordered", describeMetadataSettings([]string{"Series", "description"}, 0, false, "Description"), true},
+		{"field added", describeMetadataSettings([]string{"description", "series", "title"}, 0, false, "Description"), false},
+		{"series padded", describeMetadataSettings([]string{"description", "series"}, 2, false, "Description"), false},
+		{"html stripped", describeMetadataSettings([]string{"description", "series"}, 0, true, "Description"), false},
+		{"comments column", describeMetadataSettings([]string{"description", "series"}, 0, false, "Subtitle"), false},
+	}
+	metadataSettings = base
+	baseHash := metadataHash(meta)
+	for _, tt := range tests {
+		metadataSettings = tt.settings
+		if same := metadataHash(meta) == baseHash; same != tt.same {
+			t.Errorf("%s: hash unchanged = %t, want %t", tt.name, same, tt.same)
+		}
+	}
+}
+
+func TestImportAnnotationsContentID(t *testing.T) {
+	db := newTestDB(t, nil)
+	_, err := db.Exec("CREATE TABLE Bookmark (VolumeID TEXT, " + strings.Join(annotationColumns, ", ") + ", PRIMARY KEY (BookmarkID))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mntDir := t.TempDir()
+	bookPath := filepath.Join(mntDir, "Book.epub")
+	if err := ioutil.WriteFile(bookPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	const sidecar = `[
+		{"BookmarkID": "chapter", "ContentID": "!OEBPS!ch1.xhtml", "Text": "kept"},
+		{"BookmarkID": "null", "ContentID": null, "Text": "skipped"},
+		{"BookmarkID": "missing", "Text": "skipped"}
+	]`
+	if err := ioutil.WriteFile(bookPath+annotationSuffix, []byte(sidecar), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := importAnnotations(db, testBookDir, mntDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 1 {
+		t.Errorf("imported %d annotations, want 1", imported)
+	}
+	var id, contentID string
+	if err := db.QueryRow("SELECT BookmarkID, ContentID FROM Bookmark").Scan(&id, &contentID); err != nil {
+		t.Fatal(err)
+	}
+	if want := testIDPrefix + "/Book.epub!OEBPS!ch1.xhtml"; id != "chapter" || contentID != want {
+		t.Errorf("imported %s with ContentID %q, want chapter with %q", id, contentID, want)
+	}
+}
+
+func TestRunPhaseMessages(t *testing.T) {
+	phaseErr := errors.New("sync failed")
+	tests := []struct {
+		name    string
+		fn      func(d Display) (int, error)
+		want    []string
+		wantN   int
+		wantErr error
+	}{
+		{"success", func(d Display) (int, error) {
+			d.Println("Old phase")
+			d.Clear()
+			d.Println("Updating metadata...")
+			d.Println("Metadata 0/2 (0%)")
+			printProgress(d, "Metadata 1/2 (50%)", 0.5)
+			printProgress(d, "Metadata 2/2 (100%)", 1)
+			d.Println("Done!")
+			return 2, nil
+		}, []string{"Updating metadata...", "Metadata 2/2 (100%)", "Done!"}, 2, nil},
+		{"failure", func(d Display) (int, error) {
+			d.Println("Starting Sync... Please wait.")
+			d.PrintLastLn("Syncing Book.epub")
+			d.Println("Sync failed. Aborting!")
+			return 0, phaseErr
+		}, []string{"Syncing Book.epub", "Sync failed. Aborting!"}, 0, phaseErr},
+		{"quiet", func(d Display) (int, error) {
+			printLevel(d, levelNormal, "Shown")
+			printLevel(d, levelDebug, "Hidden")
+			return 0, nil
+		}, []string{"Shown"}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &nopDisplay{}
+			n, err := runPhase(d, "test", tt.fn)
+			if n != tt.wantN || err != tt.wantErr {
+				t.Errorf("runPhase = %d, %v, want %d, %v", n, err, tt.wantN, tt.wantErr)
+			}
+			if !reflect.DeepEqual(d.Messages, tt.want) {
+				t.Errorf("messages %q, want %q", d.Messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestPressConnectButton(t *testing.T) {
+	tests := []struct {
+		name      string
+		buttonErr error
+		wantFails int
+	}{
+		{"pressed", nil, 0},
+		{"not found", ErrButtonNotFound, 2},
+		{"press failed", ErrButtonPressFailed, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			krCfg := defaultConfig()
+			d := &nopDisplay{ButtonErr: tt.buttonErr}
+			fails := 0
+			err := pressConnectButton(d, 2, &krCfg, func(i int) { fails++ })
+			if !errors.Is(err, tt.buttonErr) || (tt.buttonErr == nil) != (err == nil) {
+				t.Errorf("pressConnectButton = %v, want %v", err, tt.buttonErr)
+			}
+			if fails != tt.wantFails {
+				t.Errorf("%d failed attempts, want %d", fails, tt.wantFails)
+			}
+		})
+	}
+}
+
+func TestKepubifyBooks(t *testing.T) {
+	// Stands in for kepubify, which is called as "kepubify -o dir book.epub"
+	kepubify := filepath.Join(t.TempDir(), "kepubify")
+	script := "#!/bin/sh\ntouch \"$2/$(basename \"$3\" .epub).kepub.epub\"\n"
+	if err := ioutil.WriteFile(kepubify, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, keepOriginal := range []bool{true, false} {
+		ksDir, krcloneDir := t.TempDir(), t.TempDir()
+		book := filepath.Join(ksDir, "Author", "Book.epub")
+		os.MkdirAll(filepath.Dir(book), 0755)
+		if err := ioutil.WriteFile(book, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		kepubifyBooks(&nopDisplay{}, kepubify, ksDir, krcloneDir, []string{book}, keepOriginal)
+		if _, err := os.Stat(filepath.Join(ksDir, "Author", "Book.kepub.epub")); err != nil {
+			t.Errorf("keep original %t: no kepub: %s", keepOriginal, err)
+		}
+		_, err := os.Stat(book)
+		if kept := err == nil; kept != keepOriginal {
+			t.Errorf("keep original %t: original kept = %t", keepOriginal, kept)
+		}
+		// Removed originals are listed, so they aren't downloaded again
+		rules, _ := ioutil.ReadFile(filepath.Join(krcloneDir, convertedFile))
+		want := ""
+		if !keepOriginal {
+			want = "/Author/Book.epub\n"
+		}
+		if string(rules) != want {
+			t.Errorf("keep original %t: converted rules %q, want %q", keepOriginal, rules, want)
+		}
+	}
+}
+
+func TestPruneKepubs(t *testing.T) {
+	ksDir := t.TempDir()
+	files := []string{
+		"Kept.epub", "Kept.kepub.epub",
+		"Upper.EPUB", "Upper.kepub.epub",
+		"Author/Deleted.kepub.epub",
+		"Other.pdf",
+	}
+	for _, f := range files {
+		path := filepath.Join(ksDir, f)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := pruneKepubs(ksDir); n != 1 {
+		t.Errorf("pruned %d kepubs, want 1", n)
+	}
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(ksDir, f))
+		if exists, want := err == nil, f != "Author/Deleted.kepub.epub"; exists != want {
+			t.Errorf("%s exists = %t, want %t", f, exists, want)
+		}
+	}
+}